@@ -0,0 +1,179 @@
+package lvbackup
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ncw/directio"
+)
+
+const DefaultJobs = 4 // writer goroutines of lvpatch
+
+// errPatchStopped is the result of the blocks left unwritten after the
+// first failure.
+var errPatchStopped = errors.New("patch stopped")
+
+// writeJob is a block on its way from the decoder to a writer. buf is the
+// aligned buffer from the pool holding the block data.
+type writeJob struct {
+	seq   uint64
+	block streamBlock
+	buf   []byte
+	sum   [sha256.Size]byte // blockDigest, only for resumable patches
+	wb    writtenBlock      // only for verified patches
+	err   error
+}
+
+// applyBlocks writes the blocks of the stream to the target. The decoder
+// runs in the calling goroutine and copies every block into a buffer of a
+// bounded pool; sr.jobs writers write them with WriteAt in any order, and
+// the completion is accounted in stream order, so the checkpoint of a
+// resumable patch never covers a block which has not been written. The
+// first skip blocks were applied by an earlier run and are only checked.
+func (sr *streamRecver) applyBlocks(dec streamDecoder, skip uint64) error {
+	jobs := make(chan *writeJob, sr.jobs)
+	results := make(chan *writeJob, 2*sr.jobs)
+	pool := make(chan []byte, 2*sr.jobs)
+	for i := 0; i < cap(pool); i++ {
+		pool <- nil // allocated on first use
+	}
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < sr.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			zeroBuf := directio.AlignedBlock(int(sr.header.BlockSize))
+			for job := range jobs {
+				select {
+				case <-stop:
+					// a block in front failed, nothing more is written
+					job.err = errPatchStopped
+					results <- job
+					continue
+				default:
+				}
+				if sr.state != nil {
+					job.sum = blockDigest(job.block)
+				}
+				if sr.verify {
+					job.wb = newWrittenBlock(job.block)
+				}
+				job.err = sr.writeBlock(job.block, zeroBuf)
+				results <- job
+			}
+		}()
+	}
+
+	progress := &patchProgress{total: int64(sr.header.BlockCount), blockSize: int64(sr.header.BlockSize)}
+	done := make(chan error, 1)
+	go func() {
+		done <- sr.complete(results, pool, stop, skip, progress)
+	}()
+
+	var decErr error
+	seq := uint64(0)
+decode:
+	for {
+		block, err := dec.nextBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			decErr = err
+			break
+		}
+
+		if seq < skip {
+			if err := sr.skipBlock(block); err != nil {
+				decErr = err
+				break
+			}
+			seq++
+			progress.add(block)
+			continue
+		}
+
+		var buf []byte
+		select {
+		case buf = <-pool:
+		case <-stop:
+			break decode
+		}
+		job := &writeJob{seq: seq, block: block}
+		if block.Data != nil {
+			buf = blockBuffer(buf, len(block.Data))
+			copy(buf, block.Data)
+			job.block.Data = buf
+		}
+		job.buf = buf
+		jobs <- job
+		seq++
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(results)
+	err := <-done
+	if decErr != nil {
+		return decErr
+	}
+	if err != nil {
+		return err
+	}
+	if seq < skip {
+		return fmt.Errorf("stream is shorter than the blocks applied by the earlier run")
+	}
+	return nil
+}
+
+// complete accounts for the written blocks in stream order, starting at
+// block next. It returns the first error and closes stop on it, which
+// makes the writers pass over the remaining jobs, and keeps draining
+// results until they are done.
+func (sr *streamRecver) complete(results <-chan *writeJob, pool chan<- []byte, stop chan struct{}, next uint64, progress *patchProgress) error {
+	pending := map[uint64]*writeJob{}
+	var err error
+	for job := range results {
+		if err == nil && job.err != nil {
+			// stop the writers before the buffer is handed out again
+			err = job.err
+			close(stop)
+		}
+		pool <- job.buf
+		if err != nil {
+			continue
+		}
+
+		pending[job.seq] = job
+		for {
+			j, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if err = sr.account(j); err != nil {
+				close(stop)
+				break
+			}
+			next++
+			progress.add(j.block)
+		}
+	}
+	return err
+}
+
+type patchProgress struct {
+	total, done int64 // chunks
+	blockSize   int64
+}
+
+func (p *patchProgress) add(block streamBlock) {
+	p.done += block.Length / p.blockSize
+	bar := print_ProcessBar(p.done, p.total)
+	fmt.Printf("\rPatch blocks %s", bar)
+}
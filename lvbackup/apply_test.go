@@ -0,0 +1,141 @@
+package lvbackup
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+)
+
+// fakeDecoder returns blocks, reusing one buffer for the data like the
+// decoders of the stream formats. It waits for pause before the block
+// after the first pauseAfter blocks.
+type fakeDecoder struct {
+	blocks     []streamBlock
+	buf        []byte
+	pauseAfter int
+	pause      time.Duration
+	read       int
+}
+
+func (d *fakeDecoder) readHeader(h *streamHeader) error { return nil }
+func (d *fakeDecoder) readBaseBlocks(h *streamHeader) ([]thindelta.BlockHash, error) {
+	return nil, nil
+}
+func (d *fakeDecoder) verifyHeader() error { return nil }
+
+func (d *fakeDecoder) nextBlock() (streamBlock, error) {
+	if len(d.blocks) == 0 {
+		return streamBlock{}, io.EOF
+	}
+	if d.read == d.pauseAfter {
+		time.Sleep(d.pause)
+	}
+	d.read++
+	b := d.blocks[0]
+	d.blocks = d.blocks[1:]
+	if b.Data != nil {
+		d.buf = append(d.buf[:0], b.Data...)
+		b.Data = d.buf
+	}
+	return b, nil
+}
+
+// applyTarget returns a file of n chunks of 0xff and blocks writing chunks
+// 0 to n-1, every fifth one zeroed, with the file content they make.
+func applyTarget(t *testing.T, n int) (*os.File, []streamBlock, []byte) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(bytes.Repeat([]byte{0xff}, n*4096)); err != nil {
+		t.Fatal(err)
+	}
+	var blocks []streamBlock
+	want := make([]byte, n*4096)
+	for i := 0; i < n; i++ {
+		if i%5 == 0 {
+			blocks = append(blocks, streamBlock{Offset: int64(i) * 4096, Length: 4096})
+			continue
+		}
+		data := bytes.Repeat([]byte{byte(i)}, 4096)
+		copy(want[i*4096:], data)
+		blocks = append(blocks, streamBlock{Offset: int64(i) * 4096, Length: 4096, Data: data})
+	}
+	return f, blocks, want
+}
+
+func TestApplyBlocks(t *testing.T) {
+	f, blocks, want := applyTarget(t, 64)
+	state := filepath.Join(t.TempDir(), "state")
+	header := streamHeader{BlockSize: 4096, BlockCount: 64}
+	sr := &streamRecver{jobs: 3, dev: f, header: header, statePath: state, state: &patchState{}}
+	if err := sr.applyBlocks(&fakeDecoder{blocks: blocks}, 0); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("target differs: %v", err)
+	}
+	if sr.applied != 64 {
+		t.Fatalf("%d blocks applied", sr.applied)
+	}
+
+	// a resumed run checks the chained digest of the blocks it skips
+	var digest [32]byte
+	for _, b := range blocks[:10] {
+		digest = chainDigest(digest, b, blockDigest(b))
+	}
+	for _, st := range []patchState{{Blocks: 10, Digest: hex.EncodeToString(digest[:])}, {Blocks: 10, Digest: "00"}} {
+		resumed := &streamRecver{jobs: 2, dev: f, header: header, statePath: state, state: &st}
+		err := resumed.applyBlocks(&fakeDecoder{blocks: blocks}, 10)
+		if st.Digest == "00" {
+			if err == nil || !strings.Contains(err.Error(), "stream does not match") {
+				t.Errorf("digest mismatch: %v", err)
+			}
+			continue
+		}
+		if err != nil || resumed.digest != sr.digest || resumed.applied != 64 {
+			t.Errorf("resumed run: %d blocks applied, %v", resumed.applied, err)
+		}
+	}
+	short := &streamRecver{jobs: 2, dev: f, header: header, statePath: state, state: &patchState{Blocks: 70}}
+	if err := short.applyBlocks(&fakeDecoder{blocks: blocks}, 70); err == nil || !strings.Contains(err.Error(), "shorter") {
+		t.Errorf("stream shorter than the applied blocks: %v", err)
+	}
+}
+
+func TestApplyBlocksWriteFailure(t *testing.T) {
+	const failing = 5
+	f, blocks, want := applyTarget(t, 64)
+	// the write of the block fails past the end of the volume
+	blocks[failing].Offset = 1 << 30
+	sr := &streamRecver{jobs: 2, dev: f, header: streamHeader{BlockSize: 4096, BlockCount: 64, VolumeSize: 64 * 4096}}
+	// the failure has stopped the writers when the next block is decoded
+	dec := &fakeDecoder{blocks: blocks, pauseAfter: failing + 1, pause: 100 * time.Millisecond}
+	err := sr.applyBlocks(dec, 0)
+	if err == nil || !strings.Contains(err.Error(), "beyond the volume size") {
+		t.Fatalf("got %v", err)
+	}
+	// blocks in front may still be in flight, none behind is accounted
+	if sr.applied > failing {
+		t.Errorf("%d blocks applied, the write of block %d failed", sr.applied, failing)
+	}
+
+	got := make([]byte, 64*4096)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := failing + 1; i < 64; i++ {
+		if bytes.Equal(got[i*4096:(i+1)*4096], want[i*4096:(i+1)*4096]) {
+			t.Errorf("block %d written after the failure", i)
+		}
+	}
+}
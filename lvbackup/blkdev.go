@@ -0,0 +1,87 @@
+package lvbackup
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	blkDiscard = 0x1277 // BLKDISCARD, _IO(0x12, 119)
+
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// discardRange discards the range of a block device, or punches a hole
+// into a regular file.
+func discardRange(f *os.File, offset, length int64) error {
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		return syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	}
+
+	r := [2]uint64{uint64(offset), uint64(length)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkDiscard, uintptr(unsafe.Pointer(&r[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// zeroRange makes the range of the device read as zeros. It discards the
+// range first, which keeps a thin volume or an image file sparse. A hole
+// punched into a file reads as zeros, but a block device may ignore the
+// discard (for example a thin pool with discards ignored) or leave the
+// partial chunks at either end of the range, so the first and the last
+// piece of the range are read back, and zeros are written if either
+// still holds data. buf is an aligned scratch buffer.
+func zeroRange(f *os.File, offset, length int64, buf []byte) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if discardRange(f, offset, length) == nil {
+		if fi.Mode().IsRegular() {
+			return nil
+		}
+		zeroed, err := endsZeroed(f, offset, length, buf)
+		if err != nil || zeroed {
+			return err
+		}
+	}
+
+	for i := range buf {
+		buf[i] = 0
+	}
+	for pos := int64(0); pos < length; pos += int64(len(buf)) {
+		b := buf
+		if length-pos < int64(len(b)) {
+			b = b[:length-pos]
+		}
+		if _, err := f.WriteAt(b, offset+pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endsZeroed reports whether the first and the last len(buf) bytes of the
+// range read as zeros.
+func endsZeroed(f *os.File, offset, length int64, buf []byte) (bool, error) {
+	for _, pos := range []int64{0, length - int64(len(buf))} {
+		if pos < 0 {
+			pos = 0
+		}
+		b := buf
+		if length-pos < int64(len(b)) {
+			b = b[:length-pos]
+		}
+		if _, err := f.ReadAt(b, offset+pos); err != nil {
+			return false, err
+		}
+		if !isZeroBlock(b) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,77 @@
+package lvbackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZeroRange(t *testing.T) {
+	data := bytes.Repeat([]byte{0xa5}, 16*4096)
+	cases := []struct {
+		name           string
+		offset, length int64
+	}{
+		{"aligned", 4096, 3 * 4096},
+		{"unaligned", 100, 5000},
+		{"unaligned end", 4096, 4096 + 1},
+		{"to the end", 12*4096 + 7, 4*4096 - 7},
+		{"within a block", 5000, 10},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "img")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zeroRange(f, c.offset, c.length, make([]byte, 4096))
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		want := append([]byte{}, data...)
+		copy(want[c.offset:c.offset+c.length], make([]byte, c.length))
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, want) {
+			t.Errorf("%s: range %d+%d not zeroed exactly", c.name, c.offset, c.length)
+		}
+	}
+}
+
+func TestEndsZeroed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img")
+	img := make([]byte, 16*4096)
+	img[4*4096] = 1
+	img[8*4096] = 1
+	img[12*4096] = 1
+	if err := os.WriteFile(path, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cases := []struct {
+		offset, length int64
+		zeroed         bool
+	}{
+		{4 * 4096, 3 * 4096, false},
+		{0, 4*4096 + 1, false},
+		{9 * 4096, 4 * 4096, false},
+		{5 * 4096, 6 * 4096, true}, // the middle is not read back
+		{13 * 4096, 100, true},
+		{4*4096 + 1, 10, true},
+	}
+	for _, c := range cases {
+		zeroed, err := endsZeroed(f, c.offset, c.length, make([]byte, 4096))
+		if err != nil || zeroed != c.zeroed {
+			t.Errorf("range %d+%d: %v, %v", c.offset, c.length, zeroed, err)
+		}
+	}
+}
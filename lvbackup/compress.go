@@ -0,0 +1,178 @@
+package lvbackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Compression algorithms of block data in a binary stream. The algorithm is
+// declared in the stream header, every write record tells with
+// FlagCompressed whether its data is compressed or stored raw.
+const (
+	CompressNone = 0
+	CompressGzip = 1
+	CompressZstd = 2
+	CompressLz4  = 3
+)
+
+var compressNames = map[string]uint8{
+	"none": CompressNone,
+	"gzip": CompressGzip,
+	"zstd": CompressZstd,
+	"lz4":  CompressLz4,
+}
+
+func ParseCompression(name string) (uint8, error) {
+	algo, ok := compressNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown compression algorithm %q", name)
+	}
+	return algo, nil
+}
+
+// blockCompressor compresses single blocks. compress returns nil if the
+// block does not get smaller. decompress fills dst, which must have the
+// length of the original block.
+type blockCompressor interface {
+	compress(src []byte) ([]byte, error)
+	decompress(dst, src []byte) error
+}
+
+func newBlockCompressor(algo uint8) (blockCompressor, error) {
+	switch algo {
+	case CompressNone:
+		return nil, nil
+	case CompressGzip:
+		return &gzipCompressor{}, nil
+	case CompressZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCompressor{enc: enc}, nil
+	case CompressLz4:
+		return &lz4Compressor{}, nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d", algo)
+}
+
+type gzipCompressor struct {
+	buf bytes.Buffer
+	w   *gzip.Writer
+	r   *gzip.Reader
+}
+
+func (c *gzipCompressor) compress(src []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.w == nil {
+		c.w = gzip.NewWriter(&c.buf)
+	} else {
+		c.w.Reset(&c.buf)
+	}
+	if _, err := c.w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	if c.buf.Len() >= len(src) {
+		return nil, nil
+	}
+	return c.buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) decompress(dst, src []byte) error {
+	var err error
+	if c.r == nil {
+		c.r, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = c.r.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c.r, dst); err != nil {
+		return err
+	}
+	if n, _ := c.r.Read(make([]byte, 1)); n != 0 {
+		return fmt.Errorf("decompressed data longer than %d bytes", len(dst))
+	}
+	return nil
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	buf []byte
+}
+
+func (c *zstdCompressor) compress(src []byte) ([]byte, error) {
+	c.buf = c.enc.EncodeAll(src, c.buf[:0])
+	if len(c.buf) >= len(src) {
+		return nil, nil
+	}
+	return c.buf, nil
+}
+
+// decompress limits the decoder to the length of dst, so a frame claiming
+// more data fails before it is decoded. Frames of small blocks still have
+// a window of zstd.MinWindowSize.
+func (c *zstdCompressor) decompress(dst, src []byte) error {
+	limit := uint64(len(dst))
+	if limit < zstd.MinWindowSize {
+		limit = zstd.MinWindowSize
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(limit))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	out, err := dec.DecodeAll(src, dst[:0])
+	if err != nil {
+		return err
+	}
+	if len(out) != len(dst) || (len(out) > 0 && &out[0] != &dst[0]) {
+		return fmt.Errorf("decompressed data does not match block length %d", len(dst))
+	}
+	return nil
+}
+
+type lz4Compressor struct {
+	buf       []byte
+	hashTable []int
+}
+
+func (c *lz4Compressor) compress(src []byte) ([]byte, error) {
+	if n := lz4.CompressBlockBound(len(src)); cap(c.buf) < n {
+		c.buf = make([]byte, n)
+	}
+	if c.hashTable == nil {
+		c.hashTable = make([]int, 1<<16)
+	}
+	for i := range c.hashTable {
+		c.hashTable[i] = 0
+	}
+	n, err := lz4.CompressBlock(src, c.buf[:cap(c.buf)], c.hashTable)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n >= len(src) {
+		return nil, nil
+	}
+	return c.buf[:n], nil
+}
+
+func (c *lz4Compressor) decompress(dst, src []byte) error {
+	n, err := lz4.UncompressBlock(src, dst)
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return fmt.Errorf("decompressed data does not match block length %d", len(dst))
+	}
+	return nil
+}
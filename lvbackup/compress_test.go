@@ -0,0 +1,110 @@
+package lvbackup
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressible(n int) []byte {
+	b := make([]byte, 0, n)
+	for i := 0; len(b) < n; i++ {
+		b = append(b, []byte("chunk of a thin volume, ")...)
+		b = append(b, byte('a'+i%26))
+	}
+	return b[:n]
+}
+
+func incompressible(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, name := range []string{"gzip", "zstd", "lz4"} {
+		algo, _ := ParseCompression(name)
+		comp, err := newBlockCompressor(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{512, 4096, 1 << 20} {
+			src := compressible(size)
+			data, err := comp.compress(src)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if data == nil || len(data) >= size {
+				t.Fatalf("%s: %d bytes compressed to %d", name, size, len(data))
+			}
+			data = append([]byte{}, data...)
+			dst := make([]byte, size)
+			if err := comp.decompress(dst, data); err != nil || !bytes.Equal(dst, src) {
+				t.Fatalf("%s: %d bytes do not round trip: %v", name, size, err)
+			}
+			if err := comp.decompress(make([]byte, size-1), data); err == nil {
+				t.Errorf("%s: %d bytes decompressed into %d", name, size, size-1)
+			}
+			if err := comp.decompress(make([]byte, size+1), data); err == nil {
+				t.Errorf("%s: %d bytes decompressed into %d", name, size, size+1)
+			}
+		}
+		if data, err := comp.compress(incompressible(4096)); err != nil || data != nil {
+			t.Errorf("%s: incompressible block compressed to %d bytes, %v", name, len(data), err)
+		}
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Error("unknown algorithm parsed")
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	packed, raw := compressible(4096), incompressible(4096)
+	for _, algo := range []uint8{CompressGzip, CompressZstd, CompressLz4} {
+		stream := writeTestStream(t, func(s *streamSender) {
+			s.SetCompression(algo)
+		}, map[int64][]byte{1: packed, 2: raw})
+		blocks, err := readTestStream(stream, nil, nil)
+		if err != nil {
+			t.Fatalf("algorithm %d: %v", algo, err)
+		}
+		if len(blocks) != 2 || !bytes.Equal(blocks[0].Data, packed) || !bytes.Equal(blocks[1].Data, raw) {
+			t.Fatalf("algorithm %d: blocks do not round trip", algo)
+		}
+
+		// the incompressible block is stored raw
+		if !bytes.Contains(stream, raw) || bytes.Contains(stream, packed) {
+			t.Errorf("algorithm %d: raw block compressed or compressible block stored raw", algo)
+		}
+		rr := recordReader{r: bytes.NewReader(stream[len(C_HEAD_V2):])}
+		var flags []uint8
+		for {
+			typ, f, _, err := rr.next()
+			if err != nil || typ == RecordEnd {
+				break
+			}
+			if typ == RecordWrite {
+				flags = append(flags, f)
+			}
+		}
+		if len(flags) != 2 || flags[0] != FlagCompressed || flags[1] != 0 {
+			t.Errorf("algorithm %d: write record flags %v", algo, flags)
+		}
+	}
+}
+
+func TestZstdDecompressionLimit(t *testing.T) {
+	enc, _ := zstd.NewWriter(nil)
+	comp, _ := newBlockCompressor(CompressZstd)
+	// frames declaring their size and frames with a window larger than it
+	for _, size := range []int{1 << 20, 64 << 20} {
+		bomb := enc.EncodeAll(make([]byte, size), nil)
+		err := comp.decompress(make([]byte, 64<<10), bomb)
+		if !errors.Is(err, zstd.ErrDecoderSizeExceeded) && !errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			t.Errorf("%d bytes decompressing to %d into a block of 64 KiB: %v", len(bomb), size, err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package lvbackup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	CipherNone      = 0
+	CipherAES256GCM = 1
+
+	KDFNone   = 0 // key read from a key file
+	KDFScrypt = 1 // key derived from a passphrase
+
+	streamKeyLength = 32
+
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	scryptMaxN = 1 << 20
+)
+
+// streamEncryption is kept in the header of an encrypted binary stream.
+// Every record after the header is sealed with a key derived from the
+// master key and Salt, so one master key can be used for many streams.
+type streamEncryption struct {
+	Cipher  uint8
+	KeyID   [8]byte // identifies the master key without revealing it
+	KDF     uint8
+	N, R, P uint32 // scrypt parameters
+	KDFSalt [16]byte
+	Salt    [32]byte
+}
+
+func (e *streamEncryption) marshal(buf *bytes.Buffer) {
+	buf.WriteByte(e.Cipher)
+	if e.Cipher == CipherNone {
+		return
+	}
+	buf.Write(e.KeyID[:])
+	buf.WriteByte(e.KDF)
+	binary.Write(buf, binary.BigEndian, e.N)
+	binary.Write(buf, binary.BigEndian, e.R)
+	binary.Write(buf, binary.BigEndian, e.P)
+	buf.Write(e.KDFSalt[:])
+	buf.Write(e.Salt[:])
+}
+
+func (e *streamEncryption) unmarshal(r *bytes.Reader) error {
+	var err error
+	if e.Cipher, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if e.Cipher == CipherNone {
+		return nil
+	}
+	if e.Cipher != CipherAES256GCM {
+		return fmt.Errorf("unknown cipher %d", e.Cipher)
+	}
+	fields := []interface{}{&e.KeyID, &e.KDF, &e.N, &e.R, &e.P, &e.KDFSalt, &e.Salt}
+	for _, f := range fields {
+		if err := binary.Read(r, binary.BigEndian, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamKey is the secret of an encrypted stream, either a key read from a
+// key file or a passphrase.
+type StreamKey struct {
+	Key        []byte
+	Passphrase []byte
+}
+
+// LoadKeyFile reads a key file holding 32 raw bytes or 64 hex digits.
+func LoadKeyFile(path string) (*StreamKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == streamKeyLength {
+		return &StreamKey{Key: data}, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != streamKeyLength {
+		return nil, fmt.Errorf("key file %s must hold %d raw bytes or %d hex digits", path, streamKeyLength, streamKeyLength*2)
+	}
+	return &StreamKey{Key: key}, nil
+}
+
+// LoadPassphraseFile reads a passphrase from the first line of a file.
+func LoadPassphraseFile(path string) (*StreamKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	data = bytes.TrimRight(data, "\r")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return &StreamKey{Passphrase: data}, nil
+}
+
+// LoadStreamKey loads the key given by either a key file or a passphrase
+// file. It returns nil if both paths are empty.
+func LoadStreamKey(keyFile, passphraseFile string) (*StreamKey, error) {
+	switch {
+	case len(keyFile) > 0 && len(passphraseFile) > 0:
+		return nil, errors.New("key file and passphrase file are exclusive")
+	case len(keyFile) > 0:
+		return LoadKeyFile(keyFile)
+	case len(passphraseFile) > 0:
+		return LoadPassphraseFile(passphraseFile)
+	}
+	return nil, nil
+}
+
+func (k *StreamKey) masterKey(e *streamEncryption) ([]byte, error) {
+	switch e.KDF {
+	case KDFNone:
+		if k.Key == nil {
+			return nil, errors.New("stream is encrypted with a key file, not a passphrase")
+		}
+		return k.Key, nil
+	case KDFScrypt:
+		if k.Passphrase == nil {
+			return nil, errors.New("stream is encrypted with a passphrase, not a key file")
+		}
+		if e.N < 2 || e.N > scryptMaxN || e.N&(e.N-1) != 0 || e.R == 0 || e.P == 0 || uint64(e.R)*uint64(e.P) >= 1<<30 {
+			return nil, fmt.Errorf("invalid scrypt parameters N=%d r=%d p=%d", e.N, e.R, e.P)
+		}
+		return scrypt.Key(k.Passphrase, e.KDFSalt[:], int(e.N), int(e.R), int(e.P), streamKeyLength)
+	}
+	return nil, fmt.Errorf("unknown key derivation function %d", e.KDF)
+}
+
+func keyMAC(master []byte, label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// newStreamEncryption generates the encryption parameters of a new stream.
+func newStreamEncryption(k *StreamKey) (*streamEncryption, error) {
+	e := &streamEncryption{Cipher: CipherAES256GCM}
+	if k.Passphrase != nil {
+		e.KDF = KDFScrypt
+		e.N, e.R, e.P = scryptN, scryptR, scryptP
+		if _, err := rand.Read(e.KDFSalt[:]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := rand.Read(e.Salt[:]); err != nil {
+		return nil, err
+	}
+
+	master, err := k.masterKey(e)
+	if err != nil {
+		return nil, err
+	}
+	copy(e.KeyID[:], keyMAC(master, "hyperlayer key id", nil))
+	return e, nil
+}
+
+// recordCipher seals the records following the header. The nonce is the
+// sequence number of the record, and the additional data binds every
+// record to the header, its position and its type, so tampered, dropped
+// or reordered records fail to open.
+type recordCipher struct {
+	aead   cipher.AEAD
+	header [sha256.Size]byte
+	seq    uint64
+	buf    []byte
+}
+
+func newRecordCipher(e *streamEncryption, k *StreamKey, header []byte) (*recordCipher, error) {
+	master, err := k.masterKey(e)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(keyMAC(master, "hyperlayer key id", nil)[:len(e.KeyID)], e.KeyID[:]) {
+		return nil, fmt.Errorf("wrong key for stream, it is encrypted with key %x", e.KeyID)
+	}
+
+	block, err := aes.NewCipher(keyMAC(master, "hyperlayer record key", e.Salt[:]))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{aead: aead, header: sha256.Sum256(header)}, nil
+}
+
+func (c *recordCipher) params(typ, flags uint8) ([]byte, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.seq)
+
+	ad := make([]byte, 0, len(c.header)+10)
+	ad = append(ad, c.header[:]...)
+	ad = append(ad, nonce[len(nonce)-8:]...)
+	ad = append(ad, typ, flags)
+	return nonce, ad
+}
+
+// seal returns the sealed payload, which is only valid until the next call.
+func (c *recordCipher) seal(typ, flags uint8, payload ...[]byte) []byte {
+	c.buf = c.buf[:0]
+	for _, p := range payload {
+		c.buf = append(c.buf, p...)
+	}
+	nonce, ad := c.params(typ, flags)
+	c.seq++
+	c.buf = c.aead.Seal(c.buf[:0], nonce, c.buf, ad)
+	return c.buf
+}
+
+// open decrypts the payload in place.
+func (c *recordCipher) open(typ, flags uint8, payload []byte) ([]byte, error) {
+	nonce, ad := c.params(typ, flags)
+	plain, err := c.aead.Open(payload[:0], nonce, payload, ad)
+	if err != nil {
+		return nil, fmt.Errorf("record %d (%q) fails authentication", c.seq, typ)
+	}
+	c.seq++
+	return plain, nil
+}
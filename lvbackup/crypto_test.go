@@ -0,0 +1,182 @@
+package lvbackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordCipher(t *testing.T) {
+	key := &StreamKey{Key: bytes.Repeat([]byte{3}, streamKeyLength)}
+	e, err := newStreamEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte("header record payload")
+	records := [][]byte{[]byte("base hashes"), bytes.Repeat([]byte{7}, 4096), {}}
+
+	seal := func() [][]byte {
+		c, err := newRecordCipher(e, key, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sealed [][]byte
+		for _, r := range records {
+			sealed = append(sealed, append([]byte{}, c.seal(RecordWrite, 0, r)...))
+		}
+		return sealed
+	}
+	sealed := seal()
+	for i, r := range records {
+		if len(r) > 0 && bytes.Contains(sealed[i], r) {
+			t.Errorf("record %d sealed in plain text", i)
+		}
+	}
+	if again := seal(); !bytes.Equal(again[1], sealed[1]) {
+		t.Error("sealing is not deterministic for the same salt and sequence")
+	}
+
+	open := func(k *StreamKey, header []byte, order []int, typ uint8) error {
+		c, err := newRecordCipher(e, k, header)
+		if err != nil {
+			return err
+		}
+		for _, i := range order {
+			plain, err := c.open(typ, 0, append([]byte{}, sealed[i]...))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(plain, records[i]) {
+				t.Fatalf("record %d opened to other data", i)
+			}
+		}
+		return nil
+	}
+	if err := open(key, header, []int{0, 1, 2}, RecordWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, header...)
+	tampered[0] ^= 1
+	cases := []struct {
+		name   string
+		key    *StreamKey
+		header []byte
+		order  []int
+		typ    uint8
+		err    string
+	}{
+		{"wrong key", &StreamKey{Key: bytes.Repeat([]byte{4}, streamKeyLength)}, header, []int{0}, RecordWrite, "wrong key for stream"},
+		{"passphrase for key", &StreamKey{Passphrase: []byte("secret")}, header, []int{0}, RecordWrite, "not a passphrase"},
+		{"reordered", key, header, []int{1, 0}, RecordWrite, "record 0 ('W') fails authentication"},
+		{"dropped", key, header, []int{0, 2}, RecordWrite, "record 1 ('W') fails authentication"},
+		{"tampered header", key, tampered, []int{0}, RecordWrite, "record 0 ('W') fails authentication"},
+		{"record type", key, header, []int{0}, RecordZero, "record 0 ('Z') fails authentication"},
+	}
+	for _, c := range cases {
+		if err := open(c.key, c.header, c.order, c.typ); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	key := &StreamKey{Passphrase: []byte("correct horse")}
+	e, err := newStreamEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.KDF != KDFScrypt || e.N != scryptN || e.KDFSalt == ([16]byte{}) {
+		t.Fatalf("%+v", e)
+	}
+	c, err := newRecordCipher(e, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := append([]byte{}, c.seal(RecordBaseHash, 0, []byte("payload"))...)
+	c, _ = newRecordCipher(e, &StreamKey{Passphrase: []byte("correct horse")}, nil)
+	if plain, err := c.open(RecordBaseHash, 0, sealed); err != nil || string(plain) != "payload" {
+		t.Fatalf("%q, %v", plain, err)
+	}
+
+	if _, err := newRecordCipher(e, &StreamKey{Passphrase: []byte("correct horsf")}, nil); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+	if _, err := newRecordCipher(e, &StreamKey{Key: bytes.Repeat([]byte{3}, streamKeyLength)}, nil); err == nil {
+		t.Error("key file opened a passphrase stream")
+	}
+	for _, p := range [][3]uint32{{0, 8, 1}, {3, 8, 1}, {scryptMaxN * 2, 8, 1}, {scryptN, 0, 1}, {scryptN, 1 << 16, 1 << 14}} {
+		bad := *e
+		bad.N, bad.R, bad.P = p[0], p[1], p[2]
+		if _, err := key.masterKey(&bad); err == nil || !strings.Contains(err.Error(), "invalid scrypt parameters") {
+			t.Errorf("scrypt N=%d r=%d p=%d: %v", p[0], p[1], p[2], err)
+		}
+	}
+}
+
+func TestLoadStreamKey(t *testing.T) {
+	dir := t.TempDir()
+	raw := bytes.Repeat([]byte{0xa5}, streamKeyLength)
+	files := map[string]string{
+		"raw":   string(raw),
+		"hex":   strings.Repeat("a5", streamKeyLength) + "\n",
+		"short": strings.Repeat("a5", streamKeyLength-1),
+		"pass":  "correct horse\r\nsecond line\n",
+		"empty": "\nsecond line\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	for _, name := range []string{"raw", "hex"} {
+		k, err := LoadStreamKey(path(name), "")
+		if err != nil || !bytes.Equal(k.Key, raw) || k.Passphrase != nil {
+			t.Errorf("key file %s: %+v, %v", name, k, err)
+		}
+	}
+	if k, err := LoadStreamKey("", path("pass")); err != nil || string(k.Passphrase) != "correct horse" || k.Key != nil {
+		t.Errorf("passphrase file: %+v, %v", k, err)
+	}
+	if k, err := LoadStreamKey("", ""); k != nil || err != nil {
+		t.Errorf("no key: %+v, %v", k, err)
+	}
+
+	bad := []struct {
+		name                string
+		keyFile, passphrase string
+	}{
+		{"short key", path("short"), ""},
+		{"passphrase as key", path("pass"), ""},
+		{"empty passphrase", "", path("empty")},
+		{"both", path("raw"), path("pass")},
+		{"missing key file", path("missing"), ""},
+	}
+	for _, c := range bad {
+		if k, err := LoadStreamKey(c.keyFile, c.passphrase); err == nil {
+			t.Errorf("%s: loaded %+v", c.name, k)
+		}
+	}
+}
+
+func TestEncryptedStream(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 4096)
+	key := &StreamKey{Key: bytes.Repeat([]byte{3}, streamKeyLength)}
+	stream := writeTestStream(t, func(s *streamSender) {
+		s.SetEncryption(key)
+	}, map[int64][]byte{5: data, 6: nil})
+	if bytes.Contains(stream, data[:64]) {
+		t.Fatal("block data in plain text")
+	}
+	blocks, err := readTestStream(stream, key, nil)
+	if err != nil || len(blocks) != 2 || !bytes.Equal(blocks[0].Data, data) || blocks[1].Data != nil {
+		t.Fatalf("%d blocks, %v", len(blocks), err)
+	}
+	if _, err := readTestStream(stream, nil, nil); err == nil || !strings.Contains(err.Error(), "key file or passphrase is required") {
+		t.Errorf("no key: %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package lvbackup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/hyperblock/lvdiff/lvbackup/hyperlayer"
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+
+	"github.com/ncw/directio"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// streamBlock is a change of the volume. Data is nil if the range has to be
+// zeroed, otherwise it holds Length bytes and is only valid until the next
+// block is read.
+type streamBlock struct {
+	Offset int64
+	Length int64
+	Data   []byte
+}
+
+// streamDecoder reads a HyperLayer stream. verifyHeader checks the header
+// signature once the base blocks have been read. nextBlock returns io.EOF
+// once the end of the stream has been reached.
+type streamDecoder interface {
+	readHeader(h *streamHeader) error
+	readBaseBlocks(h *streamHeader) ([]thindelta.BlockHash, error)
+	verifyHeader() error
+	nextBlock() (streamBlock, error)
+}
+
+// newStreamDecoder detects the format of the stream. key is only needed
+// for encrypted streams, verifier only to check signatures.
+func newStreamDecoder(bfRd *bufio.Reader, key *StreamKey, verifier *streamVerifier) (streamDecoder, error) {
+	line, err := bfRd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s", line)
+
+	switch line {
+	case C_HEAD:
+		return &textDecoder{p: hyperlayer.NewParser(bfRd, int64(len(line))), verifier: verifier}, nil
+	case C_HEAD_V2:
+		h := sha256.New()
+		h.Write([]byte(line))
+		return &binaryDecoder{rr: recordReader{r: bfRd, h: h, off: int64(len(line))}, key: key, verifier: verifier}, nil
+	}
+	return nil, fmt.Errorf("unknown stream format %q", strings.TrimSpace(line))
+}
+
+// blockBuffer returns an aligned buffer of length bytes for direct I/O,
+// reusing buf if it is large enough.
+func blockBuffer(buf []byte, length int) []byte {
+	if cap(buf) < length {
+		return directio.AlignedBlock(length)
+	}
+	return buf[:length]
+}
+
+type textDecoder struct {
+	p        *hyperlayer.Parser
+	buf      []byte
+	verifier *streamVerifier
+
+	// text streams have no trailer, so the block count of the header is
+	// the only way to detect a stream that was cut off
+	count, expect uint64
+}
+
+// checkHeaderValues returns the value a header should have and the one it
+// has instead, if its sizes can not describe a volume.
+func checkHeaderValues(h *streamHeader) (string, string) {
+	if h.BlockSize == 0 || h.BlockSize%512 != 0 {
+		return "chunk size of whole sectors", fmt.Sprintf("Chunk size: %d", h.BlockSize)
+	}
+	if h.VolumeSize > math.MaxInt64 {
+		return "volume size below 2^63 bytes", fmt.Sprintf("Volume size: %d", h.VolumeSize)
+	}
+	if h.BaseSize > math.MaxInt64 {
+		return "base size below 2^63 bytes", fmt.Sprintf("Base size: %d", h.BaseSize)
+	}
+	return "", ""
+}
+
+func (d *textDecoder) readHeader(h *streamHeader) error {
+	headBuff, err := d.p.Header()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s", headBuff)
+
+	if err := yaml.Unmarshal(headBuff, h); err != nil {
+		return &hyperlayer.SyntaxError{Offset: int64(len(C_HEAD)), Record: 1, Expected: "yaml header", Err: err}
+	}
+	if expected, found := checkHeaderValues(h); len(expected) > 0 {
+		return &hyperlayer.SyntaxError{Offset: int64(len(C_HEAD)), Record: 1, Expected: expected, Found: found}
+	}
+	h.SchemeVersion = StreamSchemeV1
+	if h.StreamType == 0 {
+		h.StreamType = StreamTypeDelta
+	}
+	d.expect = h.BlockCount
+	return nil
+}
+
+func (d *textDecoder) readBaseBlocks(h *streamHeader) ([]thindelta.BlockHash, error) {
+
+	if h.DetectLevel == 0 {
+		return nil, nil
+	}
+	baseBlocks := []thindelta.BlockHash{}
+	for {
+		baseBlock, err := d.p.BaseHash()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		baseBlocks = append(baseBlocks, baseBlock)
+	}
+	return baseBlocks, nil
+}
+
+func (d *textDecoder) verifyHeader() error {
+	if d.verifier.requireSigned() {
+		return errors.New("stream is not signed, HYPERLAYER/1.0 streams can not be signed")
+	}
+	return nil
+}
+
+func (d *textDecoder) nextBlock() (streamBlock, error) {
+	w, err := d.p.Next()
+	if err == io.EOF {
+		if d.count < d.expect {
+			return streamBlock{}, fmt.Errorf("stream truncated: got %d of %d blocks", d.count, d.expect)
+		}
+		return streamBlock{}, io.EOF
+	}
+	if err != nil {
+		return streamBlock{}, err
+	}
+
+	d.buf = blockBuffer(d.buf, int(w.Length))
+	if err := d.p.Data(d.buf); err != nil {
+		return streamBlock{}, err
+	}
+	d.count++
+
+	return streamBlock{Offset: w.Offset, Length: w.Length, Data: d.buf}, nil
+}
+
+type binaryDecoder struct {
+	rr   recordReader
+	buf  []byte
+	comp blockCompressor
+
+	key    *StreamKey
+	cipher *recordCipher
+
+	verifier   *streamVerifier
+	header     []byte // header record payload, covered by signatures
+	blockSize  int64  // chunk size of the header
+	headerSig  *streamSignature
+	trailerSig *streamSignature
+	trailerBuf []byte // trailer record payload
+	signed     bool   // header signature has been verified, so the trailer must be signed too
+
+	blocks, bytes uint64 // write and zero records, block data bytes read so far
+	trailer       bool   // trailer has been read and verified
+}
+
+func (d *binaryDecoder) readHeader(h *streamHeader) error {
+	typ, _, payload, err := d.rr.next()
+	if err != nil {
+		return err
+	}
+	if typ != RecordHeader {
+		return d.rr.malformed("header record", fmt.Sprintf("record %q", typ), nil)
+	}
+	if err := h.UnmarshalBinary(payload); err != nil {
+		return d.rr.malformed("header record", "", err)
+	}
+	if expected, found := checkHeaderValues(h); len(expected) > 0 {
+		return d.rr.malformed(expected, found, nil)
+	}
+	d.header = append([]byte{}, payload...)
+	d.blockSize = int64(h.BlockSize)
+	if d.comp, err = newBlockCompressor(h.Compression); err != nil {
+		return err
+	}
+
+	headBuf, err := yaml.Marshal(h)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s%s", headBuf, h.Meta)
+
+	if h.Encryption.Cipher != CipherNone {
+		fmt.Fprintf(os.Stderr, "Encryption: AES-256-GCM, key %x\n", h.Encryption.KeyID)
+		if d.key == nil {
+			return errors.New("stream is encrypted, a key file or passphrase is required")
+		}
+		if d.cipher, err = newRecordCipher(&h.Encryption, d.key, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the next record following the header, opened if the stream
+// is encrypted.
+func (d *binaryDecoder) next() (uint8, uint8, []byte, error) {
+	typ, flags, payload, err := d.rr.next()
+	if err != nil || d.cipher == nil {
+		return typ, flags, payload, err
+	}
+	payload, err = d.cipher.open(typ, flags, payload)
+	return typ, flags, payload, err
+}
+
+func (d *binaryDecoder) readBaseBlocks(h *streamHeader) ([]thindelta.BlockHash, error) {
+	typ, _, payload, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	if typ == RecordSignature {
+		if d.headerSig, err = d.readSignature(SigHeader, payload); err != nil {
+			return nil, d.rr.malformed("header signature record", "", err)
+		}
+		if typ, _, payload, err = d.next(); err != nil {
+			return nil, err
+		}
+	}
+	if typ != RecordBaseHash {
+		return nil, d.rr.malformed("base hash record", fmt.Sprintf("record %q", typ), nil)
+	}
+	blocks, err := decodeBaseBlocks(payload)
+	if err != nil {
+		return nil, d.rr.malformed("base hash record", "", err)
+	}
+	return blocks, nil
+}
+
+func (d *binaryDecoder) nextBlock() (streamBlock, error) {
+	typ, flags, payload, err := d.next()
+	if err == io.EOF {
+		return streamBlock{}, errors.New("stream truncated: no end record")
+	}
+	if err != nil {
+		return streamBlock{}, err
+	}
+
+	switch typ {
+	case RecordWrite:
+		if len(payload) < writeHeadLength {
+			return streamBlock{}, d.rr.malformed(fmt.Sprintf("write record of at least %d bytes", writeHeadLength), "", nil)
+		}
+		offset := int64(binary.BigEndian.Uint64(payload))
+		sum := binary.BigEndian.Uint32(payload[8:])
+		if d.trailer {
+			return streamBlock{}, d.rr.malformed("signature or end record", "write record", nil)
+		}
+		if d.buf, err = readData(d.comp, d.buf, flags, payload[writeHeadLength:]); err != nil {
+			return streamBlock{}, d.rr.malformed(fmt.Sprintf("block data at offset %d", offset), "", err)
+		}
+		if blockChecksum(d.buf) != sum {
+			return streamBlock{}, fmt.Errorf("checksum mismatch in block at offset %d", offset)
+		}
+		d.blocks++
+		d.bytes += uint64(len(d.buf))
+		return streamBlock{Offset: offset, Length: int64(len(d.buf)), Data: d.buf}, nil
+	case RecordZero:
+		if len(payload) != zeroRecordLength {
+			return streamBlock{}, d.rr.malformed(fmt.Sprintf("zero record of %d bytes", zeroRecordLength), "", nil)
+		}
+		if d.trailer {
+			return streamBlock{}, d.rr.malformed("signature or end record", "zero record", nil)
+		}
+		offset := int64(binary.BigEndian.Uint64(payload))
+		length := int64(binary.BigEndian.Uint64(payload[8:]))
+		if offset < 0 || offset%d.blockSize != 0 || length <= 0 || length%d.blockSize != 0 {
+			return streamBlock{}, d.rr.malformed(fmt.Sprintf("zero record of whole %d byte chunks", d.blockSize),
+				fmt.Sprintf("offset %d, length %d", offset, length), nil)
+		}
+		d.blocks++
+		return streamBlock{Offset: offset, Length: length}, nil
+	case RecordIndex:
+		if d.trailer {
+			return streamBlock{}, d.rr.malformed("signature or end record", "index record", nil)
+		}
+		if _, err := decodeIndex(payload); err != nil {
+			return streamBlock{}, d.rr.malformed("index record", "", err)
+		}
+		return d.nextBlock()
+	case RecordTrailer:
+		if err := d.checkTrailer(payload); err != nil {
+			return streamBlock{}, err
+		}
+		return d.nextBlock()
+	case RecordSignature:
+		if !d.trailer || d.trailerSig != nil {
+			return streamBlock{}, d.rr.malformed("write, zero, index, trailer or end record", "signature record", nil)
+		}
+		if d.trailerSig, err = d.readSignature(SigTrailer, payload); err != nil {
+			return streamBlock{}, d.rr.malformed("trailer signature record", "", err)
+		}
+		return d.nextBlock()
+	case RecordEnd:
+		if !d.trailer {
+			return streamBlock{}, errors.New("stream truncated: no trailer")
+		}
+		sig, err := d.verifier.verify(SigTrailer, d.trailerSig, d.header, d.trailerBuf)
+		if err != nil {
+			return streamBlock{}, fmt.Errorf("trailer signature: %v", err)
+		}
+		if d.signed && sig == nil {
+			return streamBlock{}, errors.New("trailer signature is missing")
+		}
+		return streamBlock{}, io.EOF
+	}
+	return streamBlock{}, d.rr.malformed("write, zero, index, trailer, signature or end record", fmt.Sprintf("record %q", typ), nil)
+}
+
+// readData places the block data of a write record into buf, which is
+// reallocated if it is too small, and returns it.
+func readData(comp blockCompressor, buf []byte, flags uint8, data []byte) ([]byte, error) {
+	if flags&FlagCompressed == 0 {
+		buf = blockBuffer(buf, len(data))
+		copy(buf, data)
+		return buf, nil
+	}
+
+	if comp == nil {
+		return buf, errors.New("compressed data in uncompressed stream")
+	}
+	if len(data) < 4 {
+		return buf, errors.New("write record too short")
+	}
+	length := binary.BigEndian.Uint32(data)
+	if length > maxRecordLength {
+		return buf, fmt.Errorf("raw length %d too large", length)
+	}
+	buf = blockBuffer(buf, int(length))
+	return buf, comp.decompress(buf, data[4:])
+}
+
+func (d *binaryDecoder) checkTrailer(payload []byte) error {
+	if d.trailer {
+		return errors.New("duplicate stream trailer")
+	}
+
+	t := streamTrailer{}
+	if err := t.unmarshal(payload); err != nil {
+		return d.rr.malformed("trailer record", "", err)
+	}
+	if t.Blocks != d.blocks || t.Bytes != d.bytes {
+		return fmt.Errorf("stream trailer mismatch: %d records (%d bytes) expected, %d records (%d bytes) received",
+			t.Blocks, t.Bytes, d.blocks, d.bytes)
+	}
+	if !bytes.Equal(t.Digest[:], d.rr.h.Sum(nil)) {
+		return errors.New("stream digest mismatch")
+	}
+
+	d.rr.h = nil
+	d.trailer = true
+	d.trailerBuf = append([]byte{}, payload...)
+	return nil
+}
+
+func (d *binaryDecoder) readSignature(kind uint8, payload []byte) (*streamSignature, error) {
+	sig := &streamSignature{}
+	if err := sig.unmarshal(payload); err != nil {
+		return nil, err
+	}
+	if sig.Kind != kind {
+		return nil, fmt.Errorf("unexpected signature kind %d", sig.Kind)
+	}
+	return sig, nil
+}
+
+func (d *binaryDecoder) verifyHeader() error {
+	sig, err := d.verifier.verify(SigHeader, d.headerSig, d.header, nil)
+	if err != nil {
+		return fmt.Errorf("header signature: %v", err)
+	}
+	if sig != nil {
+		fmt.Fprintf(os.Stderr, "Signature: good, key %x\n", sig.KeyID)
+		d.signed = true
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package lvbackup
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteRecordChecksum(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 4096)
+	stream := writeTestStream(t, nil, map[int64][]byte{5: data})
+	if _, err := readTestStream(stream, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data and the last byte of the checksum in front of it
+	at := bytes.Index(stream, data)
+	for _, i := range []int{at, at + 100, at + len(data) - 1, at - 1} {
+		bad := append([]byte{}, stream...)
+		bad[i] ^= 0x10
+		_, err := readTestStream(bad, nil, nil)
+		if err == nil || err.Error() != "checksum mismatch in block at offset 20480" {
+			t.Errorf("byte %d of the write record flipped: got %v", i-at+writeHeadLength, err)
+		}
+	}
+}
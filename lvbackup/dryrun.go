@@ -0,0 +1,64 @@
+package lvbackup
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hyperblock/lvdiff/lvbackup/lvmutil"
+	"github.com/hyperblock/lvdiff/lvbackup/vgcfg"
+)
+
+// SetDryRun checks a patch without making it: the target is validated as
+// usual and the whole stream is decoded, but no volume is created or
+// resized and the target is not opened for writing.
+func (sr *streamRecver) SetDryRun(dryRun bool) {
+	sr.dryRun = dryRun
+}
+
+// checkPoolSpace fails if the pool may run out of data space while the
+// stream is written. Every block of the stream may need a new chunk.
+func (sr *streamRecver) checkPoolSpace(pool *vgcfg.ThinPoolInfo) error {
+	free, err := lvmutil.ThinPoolFree(sr.vgname, pool.Name)
+	if err != nil {
+		return err
+	}
+	need := int64(sr.header.BlockCount) * int64(sr.header.BlockSize)
+	if need > free {
+		return fmt.Errorf("thin pool %s has %d bytes free, the stream may write %d bytes", pool.Name, free, need)
+	}
+	fmt.Printf("Thin pool %s has %d bytes free, the stream may write %d bytes.\n", pool.Name, free, need)
+	return nil
+}
+
+// dryRunBlocks decodes the rest of the stream like a patch would, which
+// checks the records, checksums and signatures, and reports what would be
+// written.
+func (sr *streamRecver) dryRunBlocks(dec streamDecoder) error {
+	var blocks, writes, zeros, writeBytes, zeroBytes int64
+	for {
+		block, err := dec.nextBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if sr.header.VolumeSize > 0 && uint64(block.Offset+block.Length) > sr.header.VolumeSize {
+			return fmt.Errorf("block at offset %d is beyond the volume size %d", block.Offset, sr.header.VolumeSize)
+		}
+		// a record of a binary stream may carry several chunks
+		n := block.Length / int64(sr.header.BlockSize)
+		blocks += n
+		if block.Data == nil {
+			zeros += n
+			zeroBytes += block.Length
+		} else {
+			writes += n
+			writeBytes += block.Length
+		}
+	}
+
+	fmt.Printf("Dry run of %s: %d blocks, %d bytes to write in %d blocks, %d bytes to zero in %d blocks.\n",
+		sr.header.Name, blocks, writeBytes, writes, zeroBytes, zeros)
+	return nil
+}
@@ -0,0 +1,273 @@
+// Package hyperlayer parses the text form of HyperLayer streams,
+// HYPERLAYER/1.0. Every error caused by malformed input is a *SyntaxError
+// locating it in the stream.
+//
+// Following the magic line, a stream consists of
+//
+//	a yaml header of 'key: value' lines, closed by an empty line
+//	base hash lines 'D <offset> <length> <type> <value>', closed by an empty
+//	line, present only if the detect level of the header is not zero
+//	write records 'W <offset> <length>', each followed by the block data
+//	and a newline
+//
+// Offsets and lengths are hexadecimal and count 512 byte sectors.
+package hyperlayer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+)
+
+const (
+	MaxLineLength = 64 << 10 // longest header or sub-header line
+	MaxDataLength = 1 << 30  // most block data in one write record, the largest thin pool chunk
+)
+
+var errLineTooLong = fmt.Errorf("line longer than %d bytes", MaxLineLength)
+
+// SyntaxError reports malformed input. Record counts from 1 for the
+// header; every base hash line and write record is a record of its own.
+type SyntaxError struct {
+	Offset   int64  // stream offset of the malformed line or data
+	Record   uint64 // number of the record
+	Expected string // syntax expected at Offset
+	Found    string // input found instead, shortened
+	Err      error  // cause, may be nil
+}
+
+func (e *SyntaxError) Error() string {
+	s := fmt.Sprintf("malformed stream at offset %d (record %d): expected %s", e.Offset, e.Record, e.Expected)
+	if len(e.Found) > 0 {
+		s += fmt.Sprintf(", found %q", e.Found)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Found shortens malformed input for a SyntaxError.
+func Found(b []byte) string {
+	const max = 32
+	if len(b) > max {
+		return string(b[:max]) + "..."
+	}
+	return string(b)
+}
+
+// Write is the sub-header of a write record, in bytes.
+type Write struct {
+	Offset int64
+	Length int64
+}
+
+// Parser reads a text stream following its magic line.
+type Parser struct {
+	r      *bufio.Reader
+	offset int64 // stream offset of the next byte
+	line   int64 // stream offset of the line read last
+	record uint64
+	data   int64 // block data of the last write record still to read
+}
+
+// NewParser returns a parser reading from r, which is at stream offset
+// offset, just behind the magic line.
+func NewParser(r *bufio.Reader, offset int64) *Parser {
+	return &Parser{r: r, offset: offset}
+}
+
+// Offset returns the stream offset of the next byte to read.
+func (p *Parser) Offset() int64 {
+	return p.offset
+}
+
+func (p *Parser) syntaxError(offset int64, expected string, found []byte, err error) error {
+	return &SyntaxError{Offset: offset, Record: p.record, Expected: expected, Found: Found(found), Err: err}
+}
+
+// readLine reads a line without its newline. It returns io.EOF only if the
+// stream ends in front of the line.
+func (p *Parser) readLine(expected string) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := p.r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > MaxLineLength {
+			return nil, p.syntaxError(p.offset, expected, line, errLineTooLong)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) == 0 {
+			return nil, io.EOF
+		}
+		if err == io.EOF {
+			return nil, p.syntaxError(p.offset, expected, line, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	p.line = p.offset
+	p.offset += int64(len(line))
+	return line[:len(line)-1], nil
+}
+
+// Header returns the yaml header, the lines in front of the first empty
+// line.
+func (p *Parser) Header() ([]byte, error) {
+	const expected = "'key: value' header line or empty line"
+	p.record = 1
+	start := p.offset
+	header := []byte{}
+	for {
+		line, err := p.readLine(expected)
+		if err == io.EOF {
+			return nil, p.syntaxError(p.offset, expected, nil, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		// long yaml values continue on indented lines
+		if line[0] != ' ' && !strings.Contains(string(line), ":") {
+			return nil, p.syntaxError(p.line, expected, line, nil)
+		}
+		header = append(header, line...)
+		header = append(header, '\n')
+	}
+	if len(header) == 0 {
+		return nil, p.syntaxError(start, "yaml header", nil, errors.New("header is empty"))
+	}
+	return header, nil
+}
+
+// BaseHash returns the next base hash line. It returns io.EOF at the empty
+// line closing them, or if the stream ends there, which it does if nothing
+// has changed.
+func (p *Parser) BaseHash() (thindelta.BlockHash, error) {
+	const expected = "base hash line 'D <offset> <length> <type> <value>' or empty line"
+	p.record++
+	line, err := p.readLine(expected)
+	if err == nil && len(line) == 0 {
+		err = io.EOF
+	}
+	if err == io.EOF {
+		p.record--
+	}
+	if err != nil {
+		return thindelta.BlockHash{}, err
+	}
+
+	fields := strings.Split(string(line), " ")
+	if len(fields) != 5 || fields[0] != "D" || len(fields[3]) == 0 || len(fields[4]) == 0 {
+		return thindelta.BlockHash{}, p.syntaxError(p.line, expected, line, nil)
+	}
+	offset, err := parseSectors(fields[1])
+	if err != nil {
+		return thindelta.BlockHash{}, p.syntaxError(p.line, "hexadecimal sector offset", line, err)
+	}
+	length, err := parseSectors(fields[2])
+	if err != nil || length == 0 {
+		return thindelta.BlockHash{}, p.syntaxError(p.line, "non-zero hexadecimal sector count", line, err)
+	}
+	return thindelta.BlockHash{
+		Offset:   offset,
+		Length:   length,
+		HashType: fields[3],
+		Value:    fields[4],
+	}, nil
+}
+
+// Next returns the sub-header of the next write record, whose block data
+// is read by Data. If Data is not called, the block data is skipped. Next
+// returns io.EOF at the end of the stream.
+func (p *Parser) Next() (Write, error) {
+	const expected = "write record 'W <offset> <length>'"
+	if p.data > 0 {
+		if err := p.Data(make([]byte, p.data)); err != nil {
+			return Write{}, err
+		}
+	}
+
+	p.record++
+	line, err := p.readLine(expected)
+	if err == io.EOF {
+		p.record--
+	}
+	if err != nil {
+		return Write{}, err
+	}
+
+	fields := strings.Split(string(line), " ")
+	if len(fields) != 3 || fields[0] != "W" {
+		return Write{}, p.syntaxError(p.line, expected, line, nil)
+	}
+	offset, err := parseSectors(fields[1])
+	if err != nil {
+		return Write{}, p.syntaxError(p.line, "hexadecimal sector offset", line, err)
+	}
+	length, err := parseSectors(fields[2])
+	if err == nil && (length == 0 || length<<9 > MaxDataLength) {
+		err = fmt.Errorf("block data must be 1 to %d bytes", MaxDataLength)
+	}
+	if err != nil {
+		return Write{}, p.syntaxError(p.line, "hexadecimal sector count", line, err)
+	}
+
+	p.data = length << 9
+	return Write{Offset: offset << 9, Length: length << 9}, nil
+}
+
+// Data reads the block data of the write record returned by Next into buf,
+// which must hold exactly its length.
+func (p *Parser) Data(buf []byte) error {
+	if int64(len(buf)) != p.data {
+		return fmt.Errorf("hyperlayer: buffer of %d bytes for %d bytes of block data", len(buf), p.data)
+	}
+	n, err := io.ReadFull(p.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return p.syntaxError(p.offset+int64(n), fmt.Sprintf("%d bytes of block data", len(buf)), nil, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return err
+	}
+	p.offset += int64(n)
+	p.data = 0
+
+	c, err := p.r.ReadByte()
+	if err == io.EOF {
+		return p.syntaxError(p.offset, "newline after block data", nil, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return err
+	}
+	if c != '\n' {
+		return p.syntaxError(p.offset, "newline after block data", []byte{c}, nil)
+	}
+	p.offset++
+	return nil
+}
+
+// parseSectors parses a hexadecimal sector number, which must be
+// representable in bytes.
+func parseSectors(s string) (int64, error) {
+	n, err := strconv.ParseUint(s, 16, 63-9)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
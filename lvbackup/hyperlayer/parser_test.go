@@ -0,0 +1,133 @@
+package hyperlayer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// magic is the length of the magic line in front of the input.
+const magic = 15
+
+func newTestParser(s string) *Parser {
+	return NewParser(bufio.NewReader(strings.NewReader(s)), magic)
+}
+
+// parseAll parses a stream, reading the block data of every write record.
+func parseAll(p *Parser) error {
+	if _, err := p.Header(); err != nil {
+		return err
+	}
+	for {
+		if _, err := p.BaseHash(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	for {
+		w, err := p.Next()
+		if err != nil {
+			return err
+		}
+		if err := p.Data(make([]byte, w.Length)); err != nil {
+			return err
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 512)
+	p := newTestParser("Name: a\nDetect level: 1\n  continued\n\nD 0 80 CRC32 abc\n\nW 8 1\n" + string(data) + "\nW 10 2\n" + strings.Repeat("y", 1024) + "\n")
+	h, err := p.Header()
+	if err != nil || string(h) != "Name: a\nDetect level: 1\n  continued\n" {
+		t.Fatalf("header %q, %v", h, err)
+	}
+	b, err := p.BaseHash()
+	if err != nil || b.Offset != 0 || b.Length != 0x80 || b.HashType != "CRC32" || b.Value != "abc" {
+		t.Fatalf("base hash %+v, %v", b, err)
+	}
+	if _, err := p.BaseHash(); err != io.EOF {
+		t.Fatalf("end of base hashes: %v", err)
+	}
+	w, err := p.Next()
+	if err != nil || w != (Write{Offset: 8 << 9, Length: 512}) {
+		t.Fatalf("write %+v, %v", w, err)
+	}
+	buf := make([]byte, 512)
+	if err := p.Data(buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("data: %v", err)
+	}
+	// the block data is skipped without Data
+	if w, err = p.Next(); err != nil || w != (Write{Offset: 0x10 << 9, Length: 1024}) {
+		t.Fatalf("write %+v, %v", w, err)
+	}
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("end of stream: %v", err)
+	}
+	if p.Offset() != magic+61+512+1+7+1024+1 {
+		t.Errorf("offset %d at the end", p.Offset())
+	}
+
+	// a stream without base hashes may end behind the header
+	p = newTestParser("Name: a\n\n")
+	if err := parseAll(p); err != io.EOF {
+		t.Errorf("stream of a header only: %v", err)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	long := strings.Repeat("x", MaxLineLength)
+	cases := []struct {
+		in       string
+		offset   int64
+		record   uint64
+		expected string
+	}{
+		{"", magic, 1, "'key: value' header line or empty line"},
+		{"Name: a\n", magic + 8, 1, "'key: value' header line or empty line"},
+		{"Name: a\nbogus\n\n", magic + 8, 1, "'key: value' header line or empty line"},
+		{"Name: a\n" + long + "\n", magic + 8, 1, "'key: value' header line or empty line"},
+		{"\n", magic, 1, "yaml header"},
+		{"Name: a\n\nD 0 80\n", magic + 9, 2, "base hash line 'D <offset> <length> <type> <value>' or empty line"},
+		{"Name: a\n\nD 0 80 CRC32 abc\nX 0 80 CRC32 abc\n", magic + 26, 3, "base hash line 'D <offset> <length> <type> <value>' or empty line"},
+		{"Name: a\n\nD 0 80 CRC32 abc\nD 0 80 CRC32 abc", magic + 26, 3, "base hash line 'D <offset> <length> <type> <value>' or empty line"},
+		{"Name: a\n\nD 0 80 CRC32 \n", magic + 9, 2, "base hash line 'D <offset> <length> <type> <value>' or empty line"},
+		{"Name: a\n\nD zz 80 CRC32 a\n", magic + 9, 2, "hexadecimal sector offset"},
+		{"Name: a\n\nD 0 0 CRC32 a\n", magic + 9, 2, "non-zero hexadecimal sector count"},
+		{"Name: a\n\n\nW 8\n", magic + 10, 2, "write record 'W <offset> <length>'"},
+		{"Name: a\n\n\nW 8 1", magic + 10, 2, "write record 'W <offset> <length>'"},
+		{"Name: a\n\n\nW -8 1\n", magic + 10, 2, "hexadecimal sector offset"},
+		{"Name: a\n\n\nW 8 0\n", magic + 10, 2, "hexadecimal sector count"},
+		{"Name: a\n\n\nW 8 200001\n", magic + 10, 2, "hexadecimal sector count"},
+		{"Name: a\n\n\nW 8 1\nshort", magic + 21, 2, "512 bytes of block data"},
+		{"Name: a\n\n\nW 8 1\n" + strings.Repeat("x", 512), magic + 528, 2, "newline after block data"},
+		{"Name: a\n\n\nW 8 1\n" + strings.Repeat("x", 513), magic + 528, 2, "newline after block data"},
+		{"Name: a\n\n\nW 8 1\n" + strings.Repeat("x", 512) + "\nW 10 1\n", magic + 536, 3, "512 bytes of block data"},
+	}
+	for _, c := range cases {
+		err := parseAll(newTestParser(c.in))
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%.40q: got %v", c.in, err)
+			continue
+		}
+		if se.Offset != c.offset || se.Record != c.record || se.Expected != c.expected {
+			t.Errorf("%.40q: got offset %d, record %d, expected %q, want offset %d, record %d, expected %q", c.in, se.Offset, se.Record, se.Expected, c.offset, c.record, c.expected)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	err := error(&SyntaxError{Offset: 20, Record: 2, Expected: "write record", Found: Found([]byte(strings.Repeat("y", 40))), Err: io.ErrUnexpectedEOF})
+	want := `malformed stream at offset 20 (record 2): expected write record, found "` + strings.Repeat("y", 32) + `...": unexpected EOF`
+	if err.Error() != want {
+		t.Errorf("got %s", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("cause not unwrapped")
+	}
+}
@@ -0,0 +1,249 @@
+package lvbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+)
+
+// Streams can be made from and applied to raw image files as well, which
+// needs neither root nor LVM. An image is compared chunk by chunk, so a
+// chunk which is all zeros counts as unmapped.
+
+const imageCopyBlock = 64 << 10 // zero runs of this size stay holes when copying
+
+// compareImages returns the chunks of the image at path which differ from
+// the base image, or all non-zero chunks if base is empty, in the form of
+// a thin_delta result, with equal non-zero chunks as same mappings. It also returns the sizes of both images.
+func compareImages(path, base string, chunkSize int64) (*thindelta.DeltaBlocks, int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size := fi.Size()
+	if size%chunkSize != 0 {
+		return nil, 0, 0, fmt.Errorf("size of image %s is not a multiple of the chunk size %d", path, chunkSize)
+	}
+
+	var bf *os.File
+	baseSize := int64(0)
+	if len(base) > 0 {
+		if bf, err = os.Open(base); err != nil {
+			return nil, 0, 0, err
+		}
+		defer bf.Close()
+		if fi, err = bf.Stat(); err != nil {
+			return nil, 0, 0, err
+		}
+		baseSize = fi.Size()
+	}
+
+	delta := &thindelta.DeltaBlocks{}
+	buf := make([]byte, chunkSize)
+	baseBuf := make([]byte, chunkSize)
+	for i := int64(0); i*chunkSize < size; i++ {
+		if _, err := f.ReadAt(buf, i*chunkSize); err != nil {
+			return nil, 0, 0, err
+		}
+		zero := isZeroBlock(buf)
+
+		baseZero := true
+		if i*chunkSize < baseSize {
+			// the last chunk of the base image may be partial
+			if _, err := (imageReader{bf}).ReadAt(baseBuf, i*chunkSize); err != nil {
+				return nil, 0, 0, err
+			}
+			baseZero = isZeroBlock(baseBuf)
+		}
+
+		switch {
+		case zero && baseZero:
+		case zero:
+			delta.Add(thindelta.DeltaOpDelete, i)
+		case baseZero:
+			delta.Add(thindelta.DeltaOpCreate, i)
+		case !bytes.Equal(buf, baseBuf):
+			delta.Add(thindelta.DeltaOpUpdate, i)
+		default:
+			delta.Add(thindelta.DeltaOpIgnore, i)
+		}
+	}
+	return delta, size, baseSize, nil
+}
+
+// imageReader reads a base image like an unmapped range of a thin lv past
+// its end: as zeros. The checksums of a delta stream cover chunks which
+// the base image does not have if the image has grown.
+type imageReader struct {
+	f *os.File
+}
+
+func (b imageReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := b.f.ReadAt(p, off)
+	if err == io.EOF {
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	return n, err
+}
+
+// copyImage copies size bytes of src to dst, leaving holes for zeros.
+func copyImage(dst, src *os.File, size int64) error {
+	buf := make([]byte, imageCopyBlock)
+	for pos := int64(0); pos < size; pos += int64(len(buf)) {
+		b := buf
+		if size-pos < int64(len(b)) {
+			b = b[:size-pos]
+		}
+		if _, err := src.ReadAt(b, pos); err != nil {
+			return err
+		}
+		if isZeroBlock(b) {
+			continue
+		}
+		if _, err := dst.WriteAt(b, pos); err != nil {
+			return err
+		}
+	}
+	return dst.Truncate(size)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// SetImages makes a stream of the raw image file instead of a thin lv,
+// against the image base if it is not empty. The image is compared in
+// chunks of chunkSize bytes.
+func (s *streamSender) SetImages(file, base string, chunkSize int64) error {
+	if chunkSize <= 0 || chunkSize%4096 != 0 {
+		return fmt.Errorf("chunk size %d is not a multiple of 4096", chunkSize)
+	}
+	s.imageFile = file
+	s.baseImage = base
+	s.chunkSize = chunkSize
+	return nil
+}
+
+func (s *streamSender) prepareImage() error {
+	deltaBlocks, size, baseSize, err := compareImages(s.imageFile, s.baseImage, s.chunkSize)
+	if err != nil {
+		return err
+	}
+
+	s.delta = deltaBlocks
+	s.header.SchemeVersion = uint8(s.scheme)
+	s.header.StreamType = StreamTypeFull
+	s.header.Compression = s.compress
+	s.header.Name = filepath.Base(s.imageFile)
+	s.header.VolumeSize = uint64(size)
+	s.header.BlockSize = uint32(s.chunkSize)
+	s.header.BlockCount = uint64(deltaBlocks.ChangedBlocks())
+	if len(s.baseImage) > 0 {
+		s.header.StreamType = StreamTypeDelta
+		s.header.DetectLevel = s.detectLv
+		s.header.BaseSize = uint64(baseSize)
+	}
+	return nil
+}
+
+// SetImages applies the stream to the raw image file target instead of a
+// thin lv. A delta stream is applied to a copy of the image base.
+func (sr *streamRecver) SetImages(target, base string) {
+	sr.targetFile = target
+	sr.baseFile = base
+}
+
+// prepareImage creates the temporary target image: a sparse copy of the
+// base image for a delta stream, an empty sparse file for a full stream.
+// It is renamed to the target file once the stream has been verified.
+func (sr *streamRecver) prepareImage() error {
+	if sr.state != nil {
+		if !fileExists(sr.state.Target) {
+			return fmt.Errorf("image %s of the state file does not exist", sr.state.Target)
+		}
+		fmt.Printf("Resume patching. (%s, %d blocks applied)\n", sr.state.Target, sr.state.Blocks)
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+		sr.tempFile = sr.state.Target
+		sr.lvname = sr.state.Target
+		return nil
+	}
+
+	if fileExists(sr.targetFile) {
+		return fmt.Errorf("image %s already exists", sr.targetFile)
+	}
+	tempFile := tempLvName(sr.targetFile)
+	if fileExists(tempFile) {
+		return fmt.Errorf("image %s of an earlier lvpatch exists, remove it first", tempFile)
+	}
+
+	var base *os.File
+	baseSize := int64(0)
+	if sr.header.StreamType != StreamTypeFull {
+		if len(sr.baseFile) == 0 {
+			return errors.New("base image is required for a delta stream")
+		}
+		var err error
+		if base, err = os.Open(sr.baseFile); err != nil {
+			return err
+		}
+		defer base.Close()
+		fi, err := base.Stat()
+		if err != nil {
+			return err
+		}
+		baseSize = fi.Size()
+
+		if sr.disableCheck == false {
+			if sr.header.BaseSize != 0 && sr.header.BaseSize != uint64(baseSize) {
+				return fmt.Errorf("size of base image %s is %d bytes, the stream expects %d bytes", sr.baseFile, baseSize, sr.header.BaseSize)
+			}
+			ok, err := thindelta.CheckBaseReader(imageReader{base}, int64(sr.header.BlockSize), sr.baseBlocks)
+			if err != nil {
+				return fmt.Errorf("Get image checksum (%s) error. %s", sr.baseFile, err.Error())
+			}
+			if !ok {
+				return fmt.Errorf("checksum incorrect.")
+			}
+		}
+	}
+
+	if sr.dryRun {
+		return nil
+	}
+
+	fmt.Printf("Create image. (%s)\n", tempFile)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	f, err := os.OpenFile(tempFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sr.tempFile = tempFile
+	sr.lvname = tempFile
+
+	if base != nil {
+		if err := copyImage(f, base, baseSize); err != nil {
+			return err
+		}
+	}
+	if sr.header.VolumeSize > 0 {
+		return f.Truncate(int64(sr.header.VolumeSize))
+	}
+	return nil
+}
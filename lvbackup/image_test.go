@@ -0,0 +1,171 @@
+package lvbackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+)
+
+// writeImages writes an image of 12 chunks and a base image of 8 chunks
+// and 100 bytes, and returns their paths and the image.
+func writeImages(t *testing.T) (string, string, []byte) {
+	base := make([]byte, 8*4096+100)
+	for i := range base {
+		base[i] = byte(i*7 + 1)
+	}
+	img := make([]byte, 12*4096)
+	copy(img, base)
+	for i := 2 * 4096; i < 3*4096; i++ {
+		img[i] = 0 // zeroed
+	}
+	for i := 5 * 4096; i < 5*4096+10; i++ {
+		img[i] ^= 0xff // changed
+	}
+	for i := 10 * 4096; i < 11*4096; i++ {
+		img[i] = 9 // new
+	}
+	dir := t.TempDir()
+	path, basePath := filepath.Join(dir, "img"), filepath.Join(dir, "base")
+	if err := os.WriteFile(path, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(basePath, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, basePath, img
+}
+
+func TestCompareImages(t *testing.T) {
+	path, basePath, _ := writeImages(t)
+	delta, size, baseSize, err := compareImages(path, basePath, 4096)
+	if err != nil || size != 12*4096 || baseSize != 8*4096+100 {
+		t.Fatalf("%d, %d bytes, %v", size, baseSize, err)
+	}
+	// chunk 8 holds the partial last chunk of the base, padded with zeros
+	want := &thindelta.DeltaBlocks{}
+	want.AddRange(thindelta.DeltaOpIgnore, 0, 2)
+	want.Add(thindelta.DeltaOpDelete, 2)
+	want.AddRange(thindelta.DeltaOpIgnore, 3, 2)
+	want.Add(thindelta.DeltaOpUpdate, 5)
+	want.AddRange(thindelta.DeltaOpIgnore, 6, 3)
+	want.Add(thindelta.DeltaOpCreate, 10)
+	if !reflect.DeepEqual(delta, want) {
+		t.Errorf("delta %+v, want %+v", delta, want)
+	}
+
+	if _, _, _, err := compareImages(path, basePath, 4096*5); err == nil {
+		t.Error("image of 12 chunks compared in chunks of 5")
+	}
+}
+
+func TestImageRoundTrip(t *testing.T) {
+	path, basePath, img := writeImages(t)
+	for _, base := range []string{basePath, ""} {
+		var stream bytes.Buffer
+		s, _ := NewStreamSender("", "", "", &stream, 3)
+		s.SetScheme(StreamSchemeV2)
+		if err := s.SetImages(path, base, 4096); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Run(nil); err != nil {
+			t.Fatalf("base %q: %v", base, err)
+		}
+
+		target := filepath.Join(t.TempDir(), "out")
+		r, _ := NewStreamRecver("", "", "", false, &stream)
+		r.SetImages(target, base)
+		if err := r.Run("out"); err != nil {
+			t.Fatalf("base %q: %v", base, err)
+		}
+		if got, err := os.ReadFile(target); err != nil || !bytes.Equal(got, img) {
+			t.Errorf("base %q: image differs, %v", base, err)
+		}
+		if fileExists(tempLvName(target)) {
+			t.Errorf("base %q: temporary image left", base)
+		}
+	}
+}
+
+func TestImageStreamRejected(t *testing.T) {
+	cases := []struct {
+		blockSize  uint32
+		volumeSize uint64
+		err        string
+	}{
+		{1536, 1 << 20, "chunk size 1536 of the stream is not a multiple of 4096"},
+		{8704, 1 << 20, "chunk size 8704 of the stream is not a multiple of 4096"},
+		{4096, 0, "stream has no volume size, it can not be patched into a file"},
+	}
+	for _, c := range cases {
+		var stream bytes.Buffer
+		s, _ := NewStreamSender("", "", "", &stream, 0)
+		s.SetScheme(StreamSchemeV2)
+		s.header = streamHeader{SchemeVersion: StreamSchemeV2, StreamType: StreamTypeFull, Name: "img", VolumeSize: c.volumeSize, BlockSize: c.blockSize}
+		s.putHeader(nil)
+		s.putBaseBlocks(nil)
+		s.putEnd()
+
+		target := filepath.Join(t.TempDir(), "out")
+		r, _ := NewStreamRecver("", "", "", false, &stream)
+		r.SetImages(target, "")
+		if err := r.Run("out"); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("got %v, want %q", err, c.err)
+		}
+		if fileExists(target) || fileExists(tempLvName(target)) {
+			t.Errorf("chunk size %d, volume size %d: image created", c.blockSize, c.volumeSize)
+		}
+	}
+}
+
+// imageStream returns a full stream of an image of 64 chunks, one record
+// each, and the image.
+func imageStream(t *testing.T) ([]byte, []byte) {
+	img := make([]byte, 64*4096)
+	for i := range img {
+		if i/4096%5 != 2 {
+			img[i] = byte(i/4096 + 1)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "img")
+	if err := os.WriteFile(path, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	s, _ := NewStreamSender("", "", "", &stream, 0)
+	s.SetScheme(StreamSchemeV2)
+	s.SetMaxExtent(4096)
+	if err := s.SetImages(path, "", 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	return stream.Bytes(), img
+}
+
+func patchImage(stream []byte, target, state string) error {
+	r, _ := NewStreamRecver("", "", "", false, bytes.NewReader(stream))
+	r.SetImages(target, "")
+	if len(state) > 0 {
+		r.SetResume(state)
+	}
+	return r.Run("out")
+}
+
+func TestImageRollback(t *testing.T) {
+	stream, _ := imageStream(t)
+	target := filepath.Join(t.TempDir(), "out")
+	for _, cut := range []int{len(C_HEAD_V2) + 200, len(stream) / 2, len(stream) - footerLength - 1} {
+		if err := patchImage(stream[:cut], target, ""); err == nil {
+			t.Fatalf("stream cut at %d of %d bytes patched", cut, len(stream))
+		}
+		if fileExists(target) || fileExists(tempLvName(target)) {
+			t.Fatalf("stream cut at %d of %d bytes: image left", cut, len(stream))
+		}
+	}
+}
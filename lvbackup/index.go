@@ -0,0 +1,301 @@
+package lvbackup
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A binary stream closes with a RecordIndex record in front of the trailer
+// and a fixed-size footer after the end record. The footer points to the
+// index, which locates the record of every volume range in the stream, so
+// a stream file can be read at random without scanning it.
+const (
+	footerMagic = "HLINDEX\x00"
+
+	indexEntryLength = 1 + 8 + 8 + 8 + 8
+	footerLength     = len(footerMagic) + 8 + 4 + 8 + 4
+)
+
+// IndexEntry locates the record of a volume range in a binary stream.
+type IndexEntry struct {
+	Type   uint8  // RecordWrite or RecordZero
+	Offset int64  // volume offset in bytes
+	Length int64  // length of the range in bytes
+	Pos    int64  // stream offset of the record
+	Seq    uint64 // number of the record following the header, the nonce of an encrypted record
+}
+
+func encodeIndex(entries []IndexEntry) []byte {
+	b := make([]byte, 4, 4+len(entries)*indexEntryLength)
+	binary.BigEndian.PutUint32(b, uint32(len(entries)))
+	var e [indexEntryLength]byte
+	for _, entry := range entries {
+		e[0] = entry.Type
+		binary.BigEndian.PutUint64(e[1:], uint64(entry.Offset))
+		binary.BigEndian.PutUint64(e[9:], uint64(entry.Length))
+		binary.BigEndian.PutUint64(e[17:], uint64(entry.Pos))
+		binary.BigEndian.PutUint64(e[25:], entry.Seq)
+		b = append(b, e[:]...)
+	}
+	return b
+}
+
+// decodeIndex decodes an index record. The entries must be sorted by volume
+// offset and must not overlap.
+func decodeIndex(b []byte) ([]IndexEntry, error) {
+	if len(b) < 4 {
+		return nil, errors.New("index record too short")
+	}
+	count := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) != uint64(count)*indexEntryLength {
+		return nil, errors.New("length of index record is wrong")
+	}
+
+	entries := make([]IndexEntry, count)
+	end := int64(0)
+	for i := range entries {
+		e := &entries[i]
+		e.Type = b[0]
+		e.Offset = int64(binary.BigEndian.Uint64(b[1:]))
+		e.Length = int64(binary.BigEndian.Uint64(b[9:]))
+		e.Pos = int64(binary.BigEndian.Uint64(b[17:]))
+		e.Seq = binary.BigEndian.Uint64(b[25:])
+		b = b[indexEntryLength:]
+
+		if e.Type != RecordWrite && e.Type != RecordZero {
+			return nil, fmt.Errorf("index entry %d has unknown record type %q", i, e.Type)
+		}
+		if e.Offset < end || e.Length <= 0 || e.Pos < 0 {
+			return nil, fmt.Errorf("index entry %d at offset %d is out of order", i, e.Offset)
+		}
+		end = e.Offset + e.Length
+	}
+	return entries, nil
+}
+
+// streamFooter follows the end record and locates the index record.
+type streamFooter struct {
+	Offset int64  // stream offset of the index record
+	Length uint32 // length of the index record, head included
+	Seq    uint64 // number of the index record
+}
+
+func (f *streamFooter) marshal() []byte {
+	b := make([]byte, footerLength)
+	n := copy(b, footerMagic)
+	binary.BigEndian.PutUint64(b[n:], uint64(f.Offset))
+	binary.BigEndian.PutUint32(b[n+8:], f.Length)
+	binary.BigEndian.PutUint64(b[n+12:], f.Seq)
+	binary.BigEndian.PutUint32(b[n+20:], blockChecksum(b[:n+20]))
+	return b
+}
+
+func (f *streamFooter) unmarshal(b []byte) error {
+	n := len(footerMagic)
+	if len(b) != footerLength || string(b[:n]) != footerMagic {
+		return errors.New("stream has no index footer")
+	}
+	if binary.BigEndian.Uint32(b[n+20:]) != blockChecksum(b[:n+20]) {
+		return errors.New("index footer checksum mismatch")
+	}
+	f.Offset = int64(binary.BigEndian.Uint64(b[n:]))
+	f.Length = binary.BigEndian.Uint32(b[n+8:])
+	f.Seq = binary.BigEndian.Uint64(b[n+12:])
+	return nil
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// StreamFile reads volume ranges from a binary stream file through its
+// index, without scanning the stream.
+type StreamFile struct {
+	Header streamHeader
+	Index  []IndexEntry // sorted by volume offset
+
+	f      *os.File
+	size   int64
+	comp   blockCompressor
+	cipher *recordCipher
+
+	buf  []byte
+	last int // index entry whose data is in buf, -1 if none
+}
+
+// OpenStreamFile opens a binary stream file. key is only needed for
+// encrypted streams.
+func OpenStreamFile(path string, key *StreamKey) (*StreamFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sf := &StreamFile{f: f, last: -1}
+	if err := sf.open(key); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sf, nil
+}
+
+func (sf *StreamFile) open(key *StreamKey) error {
+	fi, err := sf.f.Stat()
+	if err != nil {
+		return err
+	}
+	sf.size = fi.Size()
+	if sf.size < int64(len(C_HEAD_V2)+footerLength) {
+		return errors.New("not a HYPERLAYER/2.0 stream")
+	}
+
+	magic := make([]byte, len(C_HEAD_V2))
+	if _, err := sf.f.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	if string(magic) != C_HEAD_V2 {
+		return errors.New("not a HYPERLAYER/2.0 stream")
+	}
+
+	typ, _, payload, err := sf.readRecord(int64(len(C_HEAD_V2)), 0)
+	if err != nil {
+		return err
+	}
+	if typ != RecordHeader {
+		return fmt.Errorf("expect header record, got record %q", typ)
+	}
+	if err := sf.Header.UnmarshalBinary(payload); err != nil {
+		return err
+	}
+	if sf.comp, err = newBlockCompressor(sf.Header.Compression); err != nil {
+		return err
+	}
+	if sf.Header.Encryption.Cipher != CipherNone {
+		if key == nil {
+			return errors.New("stream is encrypted, a key file or passphrase is required")
+		}
+		if sf.cipher, err = newRecordCipher(&sf.Header.Encryption, key, payload); err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, footerLength)
+	if _, err := sf.f.ReadAt(b, sf.size-int64(footerLength)); err != nil {
+		return err
+	}
+	footer := streamFooter{}
+	if err := footer.unmarshal(b); err != nil {
+		return err
+	}
+	if footer.Offset < int64(len(C_HEAD_V2)) || footer.Offset+int64(footer.Length) > sf.size-int64(footerLength) {
+		return errors.New("index footer points outside of the stream")
+	}
+	typ, _, payload, err = sf.record(footer.Offset, footer.Seq)
+	if err != nil {
+		return err
+	}
+	if typ != RecordIndex || len(payload) > int(footer.Length) {
+		return errors.New("index footer does not point to the index record")
+	}
+	sf.Index, err = decodeIndex(payload)
+	return err
+}
+
+// readRecord reads the record at pos, which has n records in front of it.
+func (sf *StreamFile) readRecord(pos int64, n uint64) (uint8, uint8, []byte, error) {
+	rr := recordReader{r: io.NewSectionReader(sf.f, pos, sf.size-pos), off: pos, n: n}
+	typ, flags, payload, err := rr.next()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return typ, flags, payload, err
+}
+
+// record reads the record at pos, opened if the stream is encrypted. seq is
+// the number of the record.
+func (sf *StreamFile) record(pos int64, seq uint64) (uint8, uint8, []byte, error) {
+	typ, flags, payload, err := sf.readRecord(pos, seq+1)
+	if err != nil || sf.cipher == nil {
+		return typ, flags, payload, err
+	}
+	sf.cipher.seq = seq
+	payload, err = sf.cipher.open(typ, flags, payload)
+	return typ, flags, payload, err
+}
+
+// blockData returns the block data of index entry i.
+func (sf *StreamFile) blockData(i int) ([]byte, error) {
+	if sf.last == i {
+		return sf.buf, nil
+	}
+	e := sf.Index[i]
+	typ, flags, payload, err := sf.record(e.Pos, e.Seq)
+	if err != nil {
+		return nil, err
+	}
+	if typ != RecordWrite || len(payload) < writeHeadLength || int64(binary.BigEndian.Uint64(payload)) != e.Offset {
+		return nil, fmt.Errorf("index entry at offset %d does not point to its write record", e.Offset)
+	}
+	sf.last = -1
+	if sf.buf, err = readData(sf.comp, sf.buf, flags, payload[writeHeadLength:]); err != nil {
+		return nil, fmt.Errorf("block at offset %d: %v", e.Offset, err)
+	}
+	if int64(len(sf.buf)) != e.Length {
+		return nil, fmt.Errorf("length of block at offset %d is wrong", e.Offset)
+	}
+	if blockChecksum(sf.buf) != binary.BigEndian.Uint32(payload[8:]) {
+		return nil, fmt.Errorf("checksum mismatch in block at offset %d", e.Offset)
+	}
+	sf.last = i
+	return sf.buf, nil
+}
+
+// ReadAt reads len(p) bytes of the volume at offset off. It fails if a part
+// of the range is not carried by the stream.
+func (sf *StreamFile) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(sf.Index), func(i int) bool {
+		return sf.Index[i].Offset+sf.Index[i].Length > off
+	})
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if i >= len(sf.Index) || sf.Index[i].Offset > pos {
+			return n, fmt.Errorf("range at offset %d is not in the stream", pos)
+		}
+		e := sf.Index[i]
+		m := e.Offset + e.Length - pos
+		if m > int64(len(p)-n) {
+			m = int64(len(p) - n)
+		}
+		if e.Type == RecordZero {
+			for j := n; j < n+int(m); j++ {
+				p[j] = 0
+			}
+		} else {
+			data, err := sf.blockData(i)
+			if err != nil {
+				return n, err
+			}
+			copy(p[n:n+int(m)], data[pos-e.Offset:])
+		}
+		n += int(m)
+		i++
+	}
+	return n, nil
+}
+
+func (sf *StreamFile) Close() error {
+	return sf.f.Close()
+}
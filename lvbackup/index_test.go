@@ -0,0 +1,191 @@
+package lvbackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIndexEncoding(t *testing.T) {
+	entries := []IndexEntry{
+		{Type: RecordWrite, Offset: 0, Length: 4096, Pos: 100, Seq: 1},
+		{Type: RecordZero, Offset: 4096, Length: 1 << 40, Pos: 4220, Seq: 2},
+		{Type: RecordWrite, Offset: 1<<40 + 4096, Length: 8192, Pos: 4242, Seq: 3},
+	}
+	got, err := decodeIndex(encodeIndex(entries))
+	if err != nil || !reflect.DeepEqual(got, entries) {
+		t.Fatalf("%+v, %v", got, err)
+	}
+	if got, err := decodeIndex(encodeIndex(nil)); err != nil || len(got) != 0 {
+		t.Fatalf("empty index: %+v, %v", got, err)
+	}
+
+	withEntry := func(i int, change func(e *IndexEntry)) []byte {
+		bad := append([]IndexEntry{}, entries...)
+		change(&bad[i])
+		return encodeIndex(bad)
+	}
+	cases := []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"too short", []byte{0, 0}, "index record too short"},
+		{"count", encodeIndex(entries)[:4+2*indexEntryLength], "length of index record is wrong"},
+		{"trailing data", append(encodeIndex(entries), 0), "length of index record is wrong"},
+		{"record type", withEntry(1, func(e *IndexEntry) { e.Type = RecordTrailer }), "index entry 1 has unknown record type 'T'"},
+		{"overlap", withEntry(1, func(e *IndexEntry) { e.Offset = 4095 }), "index entry 1 at offset 4095 is out of order"},
+		{"empty range", withEntry(0, func(e *IndexEntry) { e.Length = 0 }), "index entry 0 at offset 0 is out of order"},
+		{"negative position", withEntry(2, func(e *IndexEntry) { e.Pos = -1 }), "index entry 2 at offset 1099511631872 is out of order"},
+	}
+	for _, c := range cases {
+		if _, err := decodeIndex(c.b); err == nil || err.Error() != c.err {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestStreamFooter(t *testing.T) {
+	f := streamFooter{Offset: 1 << 33, Length: 4 + 3*indexEntryLength, Seq: 42}
+	b := f.marshal()
+	if len(b) != footerLength {
+		t.Fatalf("footer of %d bytes", len(b))
+	}
+	var got streamFooter
+	if err := got.unmarshal(b); err != nil || got != f {
+		t.Fatalf("%+v, %v", got, err)
+	}
+	for i := range b {
+		bad := append([]byte{}, b...)
+		bad[i] ^= 0x40
+		want := "index footer checksum mismatch"
+		if i < len(footerMagic) {
+			want = "stream has no index footer"
+		}
+		if err := got.unmarshal(bad); err == nil || err.Error() != want {
+			t.Errorf("byte %d flipped: got %v, want %q", i, err, want)
+		}
+	}
+	if err := got.unmarshal(b[1:]); err == nil {
+		t.Error("short footer accepted")
+	}
+}
+
+// writeStreamFile writes a stream of chunks 4-7 and 12 of a volume of 20
+// chunks, with chunks 8-11 zeroed, and returns its path and the volume.
+func writeStreamFile(t *testing.T, setup func(s *streamSender)) (string, []byte) {
+	vol := make([]byte, 20*4096)
+	for i := 4 * 4096; i < 8*4096; i++ {
+		vol[i] = byte(i * 13)
+	}
+	for i := 12 * 4096; i < 13*4096; i++ {
+		vol[i] = 9
+	}
+	blocks := map[int64][]byte{8: nil, 9: nil, 10: nil, 11: nil}
+	for _, chunk := range []int64{4, 5, 6, 7, 12} {
+		blocks[chunk] = vol[chunk*4096 : (chunk+1)*4096]
+	}
+	path := filepath.Join(t.TempDir(), "stream")
+	if err := os.WriteFile(path, writeTestStream(t, setup, blocks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, vol
+}
+
+func TestStreamFileReadAt(t *testing.T) {
+	key := &StreamKey{Key: bytes.Repeat([]byte{3}, streamKeyLength)}
+	setups := map[string]func(s *streamSender){
+		"plain":     nil,
+		"gzip":      func(s *streamSender) { s.SetCompression(CompressGzip) },
+		"encrypted": func(s *streamSender) { s.SetCompression(CompressLz4); s.SetEncryption(key) },
+	}
+	for name, setup := range setups {
+		path, vol := writeStreamFile(t, setup)
+		sf, err := OpenStreamFile(path, key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(sf.Index) != 9 || sf.Index[4].Type != RecordZero || sf.Header.BlockSize != 4096 {
+			t.Fatalf("%s: index %+v", name, sf.Index)
+		}
+
+		ranges := [][2]int64{
+			{4 * 4096, 4096},
+			{4*4096 + 50, 9*4096 - 100}, // across write and zero records
+			{9*4096 + 1, 10},
+			{12*4096 + 4000, 96},
+		}
+		for _, r := range ranges {
+			got := make([]byte, r[1])
+			if n, err := sf.ReadAt(got, r[0]); err != nil || n != len(got) || !bytes.Equal(got, vol[r[0]:r[0]+r[1]]) {
+				t.Errorf("%s: range %d+%d: %d bytes, %v", name, r[0], r[1], n, err)
+			}
+		}
+		for _, r := range [][2]int64{{3 * 4096, 10}, {13*4096 - 5, 10}, {4*4096 - 1, 2}, {19 * 4096, 4096}} {
+			if _, err := sf.ReadAt(make([]byte, r[1]), r[0]); err == nil || !strings.Contains(err.Error(), "not in the stream") {
+				t.Errorf("%s: range %d+%d outside the stream: %v", name, r[0], r[1], err)
+			}
+		}
+		sf.Close()
+	}
+}
+
+func TestOpenStreamFileRejects(t *testing.T) {
+	path, _ := writeStreamFile(t, nil)
+	stream, _ := os.ReadFile(path)
+	footer := len(stream) - footerLength
+
+	write := func(name string, b []byte) string {
+		p := filepath.Join(t.TempDir(), name)
+		os.WriteFile(p, b, 0644)
+		return p
+	}
+	outside := append([]byte{}, stream...)
+	f := streamFooter{Offset: int64(footer), Length: 100, Seq: 1}
+	copy(outside[footer:], f.marshal())
+	notIndex := append([]byte{}, stream...)
+	f = streamFooter{Offset: int64(len(C_HEAD_V2)), Length: 100, Seq: 0}
+	copy(notIndex[footer:], f.marshal())
+	damaged := append([]byte{}, stream...)
+	at := bytes.Index(damaged, bytes.Repeat([]byte{9}, 4096))
+	damaged[at] ^= 1
+
+	cases := []struct {
+		name string
+		b    []byte
+		key  *StreamKey
+		err  string
+	}{
+		{"text stream", []byte(C_HEAD + strings.Repeat("x", 100)), nil, "not a HYPERLAYER/2.0 stream"},
+		{"short", stream[:len(C_HEAD_V2)+footerLength-1], nil, "not a HYPERLAYER/2.0 stream"},
+		{"no footer", stream[:footer], nil, "stream has no index footer"},
+		{"footer outside", outside, nil, "index footer points outside of the stream"},
+		{"footer not at index", notIndex, nil, "index footer does not point to the index record"},
+	}
+	for _, c := range cases {
+		if _, err := OpenStreamFile(write(c.name, c.b), c.key); err == nil || !strings.HasSuffix(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+
+	// block data is checked when it is read
+	sf, err := OpenStreamFile(write("damaged", damaged), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+	if _, err := sf.ReadAt(make([]byte, 10), 4*4096); err != nil {
+		t.Errorf("undamaged block: %v", err)
+	}
+	if _, err := sf.ReadAt(make([]byte, 10), 12*4096); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("damaged block: %v", err)
+	}
+	offset := binary.BigEndian.Uint64(damaged[at-writeHeadLength:])
+	if offset != 12*4096 {
+		t.Fatalf("write record of offset %d found", offset)
+	}
+}
@@ -0,0 +1,123 @@
+package lvbackup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hyperblock/lvdiff/lvbackup/lvmutil"
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+	"github.com/hyperblock/lvdiff/lvbackup/vgcfg"
+)
+
+// LineageTagPrefix starts the tag lvpatch sets on every volume it has
+// written, followed by the UUID of the source volume whose contents the
+// volume holds now. A delta stream can be patched in place into a volume
+// whose lineage is the source of the stream's base.
+const LineageTagPrefix = "lvpatch_source_"
+
+func lineageTag(uuid string) string {
+	return LineageTagPrefix + uuid
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetInPlace patches the stream directly into the thin lv, without a
+// snapshot. It is refused unless the lineage tag of lv names the base of
+// the stream and the base checksums match.
+func (sr *streamRecver) SetInPlace(lv string) {
+	sr.inPlace = lv
+}
+
+// prepareInPlace checks that the target of an in-place patch holds the
+// base of the stream. The lineage tag is removed before anything is
+// written, so a volume which has been patched partly is never taken as
+// a base again.
+func (sr *streamRecver) prepareInPlace(root *vgcfg.Group) error {
+	if sr.header.StreamType == StreamTypeFull || len(sr.header.DeltaSourceUUID) == 0 {
+		return errors.New("only a delta stream can be patched in place")
+	}
+	lv, ok := root.FindThinLv(sr.inPlace)
+	if !ok {
+		return errors.New("can not find thin lv " + sr.inPlace)
+	}
+	if !hasTag(lv.Tags, lineageTag(sr.header.DeltaSourceUUID)) {
+		return fmt.Errorf("thin lv %s is not tagged as a copy of volume %s, the base of the stream", lv.Name, sr.header.DeltaSourceUUID)
+	}
+	pool, ok := root.FindThinPool(lv.Pool)
+	if !ok {
+		return errors.New("can not find thin pool " + lv.Pool)
+	}
+	if pool.ChunkSize != int64(sr.header.BlockSize) {
+		return errors.New("block size does not match with that of local pool")
+	}
+
+	size := uint64(lv.ExtentCount) * uint64(root.ExtentSize())
+	if sr.header.BaseSize != 0 && sr.header.BaseSize != size {
+		return fmt.Errorf("size of thin lv %s is %d bytes, the stream expects %d bytes", lv.Name, size, sr.header.BaseSize)
+	}
+	if len(sr.baseBlocks) == 0 {
+		return errors.New("stream has no base checksums (detect level 0), it can not be patched in place")
+	}
+	devPath := lvmutil.LvDevicePath(sr.vgname, lv.Name)
+	ok, err := thindelta.CheckBase(devPath, pool.ChunkSize, sr.baseBlocks)
+	if err != nil {
+		return fmt.Errorf("Get volume checksum (%s/%s) error. %s", sr.vgname, lv.Name, err.Error())
+	}
+	if !ok {
+		return fmt.Errorf("checksum incorrect.")
+	}
+	if sr.dryRun {
+		return sr.checkPoolSpace(pool)
+	}
+
+	fmt.Printf("Patch volume in place. (%s)\n", lv.Name)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.lvname = lv.Name
+	if err := lvmutil.AddLvTag(sr.vgname, lv.Name, IncompleteTag); err != nil {
+		return err
+	}
+	if err := lvmutil.DelLvTag(sr.vgname, lv.Name, lineageTag(sr.header.DeltaSourceUUID)); err != nil {
+		return err
+	}
+	return sr.resizeTarget(size)
+}
+
+// setLineage tags the patched volume with the UUID of the volume it is a
+// copy of now, replacing the tags of earlier patches. sr.mu must be held.
+func (sr *streamRecver) setLineage() error {
+	if len(sr.header.VolumeUUID) == 0 {
+		return nil
+	}
+	root, err := vgcfg.Dump(sr.vgname)
+	if err != nil {
+		return err
+	}
+	lv, ok := root.FindThinLv(sr.lvname)
+	if !ok {
+		return errors.New("can not find thin lv " + sr.lvname)
+	}
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, LineageTagPrefix) {
+			if err := lvmutil.DelLvTag(sr.vgname, lv.Name, tag); err != nil {
+				return err
+			}
+		}
+	}
+	return lvmutil.AddLvTag(sr.vgname, lv.Name, lineageTag(sr.header.VolumeUUID))
+}
+
+// abandonInPlace reports a volume left incomplete by an in-place patch
+// which can not be resumed.
+func (sr *streamRecver) abandonInPlace() {
+	fmt.Fprintf(os.Stderr, "Volume %s is incomplete and tagged %s, restore it from a full stream.\n", sr.lvname, IncompleteTag)
+}
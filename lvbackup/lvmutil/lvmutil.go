@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func LvDevicePath(vgname, lvname string) string {
@@ -59,13 +61,19 @@ func CreateSnapshotLv(vgname, lvname, snapname string) error {
 	return myRunCmd(cmd)
 }
 
-func ResizeLv(vgname, lvname string, size int64) error {
+// ResizeLv sets the size of a logical volume. Shrinking it needs force.
+func ResizeLv(vgname, lvname string, size int64, force bool) error {
 	path, err := exec.LookPath("lvresize")
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(path, "--size", fmt.Sprintf("%db", size), fmt.Sprintf("%s/%s", vgname, lvname))
+	var cmd *exec.Cmd
+	if force {
+		cmd = exec.Command(path, "-f", "--size", fmt.Sprintf("%db", size), fmt.Sprintf("%s/%s", vgname, lvname))
+	} else {
+		cmd = exec.Command(path, "--size", fmt.Sprintf("%db", size), fmt.Sprintf("%s/%s", vgname, lvname))
+	}
 	cmd.Stderr = os.Stderr
 	return myRunCmd(cmd)
 }
@@ -136,3 +144,55 @@ func SetLvActivationSkip(vgname, lvname string, skip bool) error {
 	cmd.Stderr = os.Stderr
 	return myRunCmd(cmd)
 }
+
+func AddLvTag(vgname, lvname, tag string) error {
+	path, err := exec.LookPath("lvchange")
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, "--addtag", tag, fmt.Sprintf("%s/%s", vgname, lvname))
+	cmd.Stderr = os.Stderr
+	return myRunCmd(cmd)
+}
+
+func DelLvTag(vgname, lvname, tag string) error {
+	path, err := exec.LookPath("lvchange")
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, "--deltag", tag, fmt.Sprintf("%s/%s", vgname, lvname))
+	cmd.Stderr = os.Stderr
+	return myRunCmd(cmd)
+}
+
+// ThinPoolFree returns the bytes of the data space of a thin pool which
+// are not allocated yet.
+func ThinPoolFree(vgname, poolname string) (int64, error) {
+	path, err := exec.LookPath("lvs")
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(path, "--noheadings", "--nosuffix", "--units", "b",
+		"-o", "lv_size,data_percent", fmt.Sprintf("%s/%s", vgname, poolname))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("command %s failed: %s", filepath.Base(cmd.Path), err.Error())
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected output of lvs: %q", out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	percent, err := strconv.ParseFloat(strings.Replace(fields[1], ",", ".", 1), 64)
+	if err != nil {
+		return 0, err
+	}
+	return size - int64(float64(size)*percent/100), nil
+}
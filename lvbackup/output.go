@@ -0,0 +1,345 @@
+package lvbackup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// C_MANIFEST starts the manifest of a stream split into segment files. It
+// is followed by one line per segment in stream order, '<SHA-256>  <file>'
+// as written by sha256sum, the file relative to the manifest.
+const C_MANIFEST = "HYPERLAYER-SEGMENTS/1.0\n"
+
+// StreamOutput writes a stream to a file, or to numbered segment files of
+// at most a split size listed by a manifest. Everything is written to
+// temporary files which only replace the output once Commit succeeds.
+// Segments are numbered apart from those of an earlier manifest at the
+// output, which stay intact until the new manifest replaces it.
+type StreamOutput struct {
+	path      string
+	splitSize int64 // 0 to write a single file
+
+	f     *os.File // temporary file of the current segment
+	n     int64    // bytes in f
+	h     hash.Hash
+	sums  []string // SHA-256 of the finished segments
+	temps []string // temporary files, in stream order
+}
+
+// CreateOutput starts writing a stream to path, split into segments of at
+// most splitSize bytes unless splitSize is 0.
+func CreateOutput(path string, splitSize int64) (*StreamOutput, error) {
+	if splitSize < 0 {
+		return nil, fmt.Errorf("invalid split size %d", splitSize)
+	}
+	o := &StreamOutput{path: path, splitSize: splitSize}
+	if err := o.next(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// segment returns the name of segment file i.
+func (o *StreamOutput) segment(i int) string {
+	return fmt.Sprintf("%s.%03d", o.path, i)
+}
+
+// next finishes the current segment and starts a new one.
+func (o *StreamOutput) next() error {
+	if o.f != nil {
+		if err := o.finish(); err != nil {
+			return err
+		}
+	}
+	tmp := o.path + ".tmp"
+	if o.splitSize > 0 {
+		tmp = o.segment(len(o.temps)) + ".tmp"
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	o.f, o.n, o.h = f, 0, sha256.New()
+	o.temps = append(o.temps, tmp)
+	return nil
+}
+
+// finish syncs and closes the current segment.
+func (o *StreamOutput) finish() error {
+	f := o.f
+	o.f = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	o.sums = append(o.sums, hex.EncodeToString(o.h.Sum(nil)))
+	return nil
+}
+
+func (o *StreamOutput) Write(p []byte) (int, error) {
+	if o.f == nil {
+		return 0, errors.New("write to a closed stream output")
+	}
+	written := 0
+	for len(p) > 0 {
+		b := p
+		if o.splitSize > 0 {
+			if o.n == o.splitSize {
+				if err := o.next(); err != nil {
+					return written, err
+				}
+			}
+			if int64(len(b)) > o.splitSize-o.n {
+				b = b[:o.splitSize-o.n]
+			}
+		}
+		n, err := o.f.Write(b)
+		o.h.Write(b[:n])
+		o.n += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Commit syncs the stream and moves it into place. The manifest of a split
+// stream is written last, so it only lists complete segments. The segments
+// of an earlier manifest are removed once it has been replaced.
+func (o *StreamOutput) Commit() error {
+	if err := o.finish(); err != nil {
+		o.Abort()
+		return err
+	}
+	old := o.oldSegments()
+	if o.splitSize == 0 {
+		if err := os.Rename(o.temps[0], o.path); err != nil {
+			o.Abort()
+			return err
+		}
+		o.temps = nil
+		if err := syncDir(o.path); err != nil {
+			return err
+		}
+		removeSegments(old, nil)
+		return nil
+	}
+
+	first := firstSegment(old, len(o.temps), o.segment)
+	names := map[string]bool{}
+	manifest := C_MANIFEST
+	for i, tmp := range o.temps {
+		name := o.segment(first + i)
+		if err := os.Rename(tmp, name); err != nil {
+			o.temps = o.temps[i:]
+			o.Abort()
+			removeSegments(names, nil)
+			return err
+		}
+		names[filepath.Clean(name)] = true
+		manifest += fmt.Sprintf("%s  %s\n", o.sums[i], filepath.Base(name))
+	}
+	o.temps = nil
+	if err := writeFileAtomic(o.path, []byte(manifest), 0666); err != nil {
+		removeSegments(names, nil)
+		return err
+	}
+	removeSegments(old, names)
+	return nil
+}
+
+// oldSegments returns the segment files listed by an earlier manifest at
+// the output, nil if there is none. Only files named like the segments of
+// the output are returned, whatever else the manifest lists.
+func (o *StreamOutput) oldSegments() map[string]bool {
+	f, err := os.Open(o.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(len(C_MANIFEST)); string(head) != C_MANIFEST {
+		return nil
+	}
+	r.Discard(len(C_MANIFEST))
+	files, _, err := readManifest(r, o.path)
+	if err != nil {
+		return nil
+	}
+	prefix := filepath.Clean(o.path) + "."
+	old := map[string]bool{}
+	for _, file := range files {
+		name := filepath.Clean(file)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := strconv.ParseUint(name[len(prefix):], 10, 32); err == nil {
+			old[name] = true
+		}
+	}
+	return old
+}
+
+// firstSegment returns the first number of n segments named by segment
+// none of which is one of the old segments.
+func firstSegment(old map[string]bool, n int, segment func(int) string) int {
+	first := 0
+	for i := 0; i < n; i++ {
+		if old[filepath.Clean(segment(first+i))] {
+			first += i + 1
+			i = -1
+		}
+	}
+	return first
+}
+
+// removeSegments removes the segment files which are not kept.
+func removeSegments(segments, keep map[string]bool) {
+	for file := range segments {
+		if !keep[file] {
+			os.Remove(file)
+		}
+	}
+}
+
+// Abort removes the temporary files, leaving any earlier output in place.
+func (o *StreamOutput) Abort() {
+	if o.f != nil {
+		o.f.Close()
+		o.f = nil
+	}
+	for _, tmp := range o.temps {
+		os.Remove(tmp)
+	}
+	o.temps = nil
+}
+
+// streamInput reads a stream file, or the segments of a split stream as
+// one stream, checking the SHA-256 of every segment at its end.
+type streamInput struct {
+	r     *bufio.Reader
+	f     *os.File
+	files []string // segments still to read
+	sums  []string
+	h     hash.Hash // of the current segment, nil for a stream file
+	sum   string    // expected SHA-256 of the current segment
+	err   error     // sticky error, io.EOF past the last segment
+}
+
+// OpenInput opens the stream file at path. If it is a manifest written by
+// lvdiff --split-size, the segments it lists are read in turn.
+func OpenInput(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(len(C_MANIFEST)); string(head) != C_MANIFEST {
+		return &streamInput{r: r, f: f}, nil
+	}
+
+	r.Discard(len(C_MANIFEST))
+	files, sums, err := readManifest(r, path)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: manifest lists no segments", path)
+	}
+	in := &streamInput{files: files, sums: sums}
+	if err := in.nextSegment(); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// readManifest reads the segment lines of a manifest at path, following
+// its first line, and returns the segment files and their SHA-256.
+func readManifest(r *bufio.Reader, path string) ([]string, []string, error) {
+	var files, sums []string
+	for line := 2; ; line++ {
+		s, err := r.ReadString('\n')
+		if err == io.EOF && len(s) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		fields := strings.SplitN(strings.TrimSuffix(s, "\n"), "  ", 2)
+		if len(fields) != 2 || len(fields[1]) == 0 {
+			return nil, nil, fmt.Errorf("%s:%d: malformed segment line %q", path, line, s)
+		}
+		if sum, err := hex.DecodeString(fields[0]); err != nil || len(sum) != sha256.Size {
+			return nil, nil, fmt.Errorf("%s:%d: malformed SHA-256 %q", path, line, fields[0])
+		}
+		files = append(files, filepath.Join(filepath.Dir(path), fields[1]))
+		sums = append(sums, strings.ToLower(fields[0]))
+	}
+	return files, sums, nil
+}
+
+// nextSegment opens the next segment of a split stream.
+func (in *streamInput) nextSegment() error {
+	f, err := os.Open(in.files[0])
+	if err != nil {
+		return err
+	}
+	in.f, in.r = f, bufio.NewReader(f)
+	in.h, in.sum = sha256.New(), in.sums[0]
+	in.files, in.sums = in.files[1:], in.sums[1:]
+	return nil
+}
+
+func (in *streamInput) Read(p []byte) (int, error) {
+	if in.err != nil {
+		return 0, in.err
+	}
+	for {
+		n, err := in.r.Read(p)
+		if in.h == nil {
+			return n, err
+		}
+		in.h.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		// end of a segment
+		in.f.Close()
+		if sum := hex.EncodeToString(in.h.Sum(nil)); sum != in.sum {
+			in.err = fmt.Errorf("segment %s: SHA-256 %s, the manifest lists %s", in.f.Name(), sum, in.sum)
+		} else if len(in.files) == 0 {
+			in.err = io.EOF
+		} else {
+			in.err = in.nextSegment()
+		}
+		if in.err != nil {
+			in.f = nil
+			return 0, in.err
+		}
+	}
+}
+
+func (in *streamInput) Close() error {
+	if in.f == nil {
+		return nil
+	}
+	return in.f.Close()
+}
@@ -0,0 +1,211 @@
+package lvbackup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeOutput writes data to path in writes of random sizes and commits it.
+func writeOutput(t *testing.T, path string, splitSize int64, data []byte) {
+	o, err := CreateOutput(path, splitSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(int64(len(data))))
+	for p := data; len(p) > 0; {
+		n := rnd.Intn(4000) + 1
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := o.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := o.Commit(); err != nil {
+		t.Fatalf("split size %d: %v", splitSize, err)
+	}
+}
+
+func readInput(path string) ([]byte, error) {
+	in, err := OpenInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return io.ReadAll(in)
+}
+
+// outputFiles returns the names of the files in dir.
+func outputFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestOutputRoundTrip(t *testing.T) {
+	data := incompressible(10000)
+	cases := []struct {
+		splitSize int64
+		files     []string
+	}{
+		{0, []string{"s"}},
+		{3000, []string{"s", "s.000", "s.001", "s.002", "s.003"}},
+		{5000, []string{"s", "s.000", "s.001"}},
+		{10000, []string{"s", "s.000"}},
+		{20000, []string{"s", "s.000"}},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "s")
+		writeOutput(t, path, c.splitSize, data)
+		if got, err := readInput(path); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("split size %d: %d bytes read back, %v", c.splitSize, len(got), err)
+		}
+		if files := outputFiles(t, dir); strings.Join(files, " ") != strings.Join(c.files, " ") {
+			t.Errorf("split size %d: files %v", c.splitSize, files)
+		}
+	}
+
+	// the manifest lists the segments in the format of sha256sum
+	dir := t.TempDir()
+	path := filepath.Join(dir, "s")
+	writeOutput(t, path, 6000, data)
+	manifest, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(manifest), "\n"), "\n")
+	if len(lines) != 3 || lines[0]+"\n" != C_MANIFEST {
+		t.Fatalf("manifest %q", manifest)
+	}
+	for i, name := range []string{"s.000", "s.001"} {
+		b, _ := os.ReadFile(filepath.Join(dir, name))
+		sum := sha256.Sum256(b)
+		if want := hex.EncodeToString(sum[:]) + "  " + name; lines[i+1] != want {
+			t.Errorf("manifest line %q, want %q", lines[i+1], want)
+		}
+	}
+}
+
+func TestOutputReplace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "s")
+	long, short := incompressible(10000), compressible(4000)
+
+	// the segments of the earlier output are not overwritten, and removed
+	// once they are no longer listed
+	writeOutput(t, path, 3000, long)
+	writeOutput(t, path, 3000, short)
+	if got, err := readInput(path); err != nil || !bytes.Equal(got, short) {
+		t.Fatalf("replacing output: %v", err)
+	}
+	if files := outputFiles(t, dir); strings.Join(files, " ") != "s s.004 s.005" {
+		t.Errorf("files %v", files)
+	}
+	writeOutput(t, path, 3000, long)
+	if files := outputFiles(t, dir); strings.Join(files, " ") != "s s.000 s.001 s.002 s.003" {
+		t.Errorf("files %v", files)
+	}
+	writeOutput(t, path, 0, short)
+	if files := outputFiles(t, dir); strings.Join(files, " ") != "s" {
+		t.Errorf("files %v", files)
+	}
+
+	// a failed commit leaves the earlier output readable
+	writeOutput(t, path, 3000, long)
+	if err := os.Mkdir(path+".005", 0755); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := CreateOutput(path, 1000)
+	o.Write(short)
+	if err := o.Commit(); err == nil {
+		t.Fatal("segment renamed onto a directory")
+	}
+	if got, err := readInput(path); err != nil || !bytes.Equal(got, long) {
+		t.Fatalf("output after a failed commit: %v", err)
+	}
+	if files := outputFiles(t, dir); strings.Join(files, " ") != "s s.000 s.001 s.002 s.003 s.005" {
+		t.Errorf("files after a failed commit %v", files)
+	}
+	os.Remove(path + ".005")
+
+	// so does an aborted one
+	o, _ = CreateOutput(path, 0)
+	o.Write(short)
+	o.Abort()
+	if got, err := readInput(path); err != nil || !bytes.Equal(got, long) {
+		t.Fatalf("output after abort: %v", err)
+	}
+	if files := outputFiles(t, dir); strings.Join(files, " ") != "s s.000 s.001 s.002 s.003" {
+		t.Errorf("files after abort %v", files)
+	}
+
+	// only segments of the output are removed, whatever a manifest lists
+	other := filepath.Join(dir, "other")
+	os.WriteFile(other, nil, 0644)
+	os.WriteFile(path, []byte(C_MANIFEST+strings.Repeat("0", 64)+"  other\n"+strings.Repeat("0", 64)+"  s.x\n"), 0644)
+	writeOutput(t, path, 0, short)
+	if !fileExists(other) {
+		t.Error("file listed by a manifest removed")
+	}
+}
+
+func TestInputRejects(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "s")
+	data := incompressible(10000)
+	writeOutput(t, path, 3000, data)
+
+	// a segment changed after the manifest was written
+	seg := path + ".002"
+	b, _ := os.ReadFile(seg)
+	b[7] ^= 1
+	os.WriteFile(seg, b, 0644)
+	got, err := readInput(path)
+	if err == nil || !strings.Contains(err.Error(), "segment "+seg+": SHA-256") {
+		t.Errorf("changed segment: %v", err)
+	}
+	// the segment is checked at its end, after its data has been read
+	if len(got) != 9000 {
+		t.Errorf("%d bytes read up to the end of the changed segment", len(got))
+	}
+	b[7] ^= 1
+	os.WriteFile(seg, b[:len(b)-1], 0644)
+	if _, err := readInput(path); err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("truncated segment: %v", err)
+	}
+	os.Remove(seg)
+	if _, err := readInput(path); err == nil || !os.IsNotExist(err) {
+		t.Errorf("missing segment: %v", err)
+	}
+
+	sum := strings.Repeat("ab", 32)
+	manifests := []struct {
+		name, manifest, err string
+	}{
+		{"empty", "", "manifest lists no segments"},
+		{"no separator", sum + " s.000\n", "2: malformed segment line"},
+		{"no file", sum + "  \n", "2: malformed segment line"},
+		{"short sum", sum[2:] + "  s.000\n", "2: malformed SHA-256"},
+		{"not hex", sum + "  s.000\nzz" + sum[2:] + "  s.001\n", "3: malformed SHA-256"},
+	}
+	for _, m := range manifests {
+		os.WriteFile(path, []byte(C_MANIFEST+m.manifest), 0644)
+		if _, err := OpenInput(path); err == nil || !strings.Contains(err.Error(), m.err) {
+			t.Errorf("%s: got %v, want %q", m.name, err, m.err)
+		}
+	}
+}
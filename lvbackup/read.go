@@ -0,0 +1,160 @@
+package lvbackup
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+
+	"github.com/ncw/directio"
+)
+
+const DefaultReadDepth = 8 // runs of chunks lvdiff reads ahead
+
+// readJob is a run of changed chunks on its way from a reader to the
+// emitter. buf is the aligned buffer from the pool, nil until the first run
+// which has to be read takes it.
+type readJob struct {
+	seq      int
+	begin, n int64 // chunk index and count
+	zero     bool  // deleted run, not read
+	buf      []byte
+	err      error
+}
+
+// SetReadDepth sets how many runs of chunks are read ahead of the one
+// being sent, each by a goroutine of its own.
+func (s *streamSender) SetReadDepth(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid read depth %d", n)
+	}
+	s.readDepth = n
+	return nil
+}
+
+// sendExtents reads the changed runs of chunks from dev and sends them.
+// Runs are read by s.readDepth readers with ReadAt in any order, each into
+// a buffer of a bounded pool, while the calling goroutine sends them in
+// stream order, so at most s.readDepth runs of up to the max extent size
+// are held in memory.
+func (s *streamSender) sendExtents(dev io.ReaderAt, blockSize int64) error {
+	// runs of changed chunks are read with one large read each, up to
+	// the max extent size
+	chunks := s.maxExtent / blockSize
+	if chunks < 1 || s.scheme != StreamSchemeV2 {
+		chunks = 1
+	}
+
+	jobs := make(chan *readJob, s.readDepth)
+	results := make(chan *readJob, s.readDepth)
+	pool := make(chan []byte, s.readDepth)
+	for i := 0; i < cap(pool); i++ {
+		pool <- nil // allocated on first use
+	}
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.readDepth; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if job.err == nil && !job.zero {
+					_, job.err = dev.ReadAt(job.buf[:job.n*blockSize], job.begin*blockSize)
+				}
+				results <- job
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer close(jobs)
+		seq := 0
+		changes := thindelta.Changes(s.delta.Ranges())
+		for {
+			e, err := changes.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				select {
+				case jobs <- &readJob{seq: seq, err: err}:
+				case <-stop:
+				}
+				return
+			}
+			for begin := e.OriginBegin; begin < e.OriginBegin+e.Length; begin += chunks {
+				n := e.OriginBegin + e.Length - begin
+				if n > chunks {
+					n = chunks
+				}
+				// every run holds a buffer of the pool, read or not,
+				// which bounds the runs in flight
+				var buf []byte
+				select {
+				case buf = <-pool:
+				case <-stop:
+					return
+				}
+				zero := e.OpType == thindelta.DeltaOpDelete
+				if buf == nil && (!zero || s.scheme != StreamSchemeV2) {
+					buf = directio.AlignedBlock(int(chunks * blockSize))
+				}
+				job := &readJob{seq: seq, begin: begin, n: n, zero: zero, buf: buf}
+				select {
+				case jobs <- job:
+				case <-stop:
+					return
+				}
+				seq++
+			}
+		}
+	}()
+
+	pending := map[int]*readJob{}
+	next := 0
+	var err error
+	for job := range results {
+		if err != nil {
+			continue
+		}
+		pending[job.seq] = job
+		for {
+			j, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			err = s.sendRun(j, blockSize)
+			if err != nil {
+				close(stop)
+				break
+			}
+			pool <- j.buf
+			next++
+		}
+	}
+	return err
+}
+
+// sendRun sends the run of chunks of job.
+func (s *streamSender) sendRun(job *readJob, blockSize int64) error {
+	if job.err != nil {
+		return job.err
+	}
+	if job.zero && s.scheme == StreamSchemeV2 {
+		return s.putZero(job.begin*blockSize, job.n*blockSize)
+	}
+	b := job.buf[:job.n*blockSize]
+	if job.zero {
+		for i := 0; i < len(b); i++ {
+			b[i] = 0
+		} // clear chunk data
+	}
+	return s.putExtent(job.begin, blockSize, b)
+}
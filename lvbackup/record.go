@@ -0,0 +1,196 @@
+package lvbackup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/hyperblock/lvdiff/lvbackup/hyperlayer"
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+)
+
+// A HYPERLAYER/2.0 stream is the C_HEAD_V2 line followed by records and the
+// index footer. Every record starts with a fixed head: record type, flags
+// and the big-endian length of the payload that follows.
+const (
+	RecordHeader    = 'H' // marshaled streamHeader
+	RecordBaseHash  = 'D' // hashes of base volume blocks
+	RecordWrite     = 'W' // volume offset in bytes, CRC32C of block data, block data
+	RecordZero      = 'Z' // volume offset and length in bytes of a range reading as zeros
+	RecordIndex     = 'I' // IndexEntry of every write and zero record
+	RecordTrailer   = 'T' // streamTrailer
+	RecordSignature = 'S' // streamSignature of the header or the trailer
+	RecordEnd       = 'E' // no payload, last record of the stream
+
+	FlagCompressed = 0x01 // write record data is compressed, preceded by its raw length
+
+	recordHeadLength = 6
+	writeHeadLength  = 12 // offset and checksum in front of write record data
+	zeroRecordLength = 16
+	trailerLength    = 16 + sha256.Size
+	maxRecordLength  = 1<<30 + 4096
+)
+
+func writeRecord(w io.Writer, typ, flags uint8, payload ...[]byte) error {
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+	if length > maxRecordLength {
+		return fmt.Errorf("record %c too large: %d bytes", typ, length)
+	}
+
+	var head [recordHeadLength]byte
+	head[0] = typ
+	head[1] = flags
+	binary.BigEndian.PutUint32(head[2:], uint32(length))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	for _, p := range payload {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type recordReader struct {
+	r   io.Reader
+	buf []byte
+	h   hash.Hash // if set, hashes every record read except the trailer
+
+	off int64  // stream offset of the next record
+	pos int64  // stream offset of the record read last
+	n   uint64 // records read, the header included
+}
+
+// next returns the next record of the stream. The payload is only valid
+// until the following call. io.EOF is returned only if the stream ends
+// exactly on a record boundary.
+func (rr *recordReader) next() (uint8, uint8, []byte, error) {
+	rr.pos = rr.off
+	rr.n++
+	var head [recordHeadLength]byte
+	if n, err := io.ReadFull(rr.r, head[:]); err != nil {
+		if err == io.EOF {
+			rr.n--
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = rr.malformed("record head", hyperlayer.Found(head[:n]), err)
+		}
+		return 0, 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(head[2:])
+	if length > maxRecordLength {
+		return 0, 0, nil, rr.malformed(fmt.Sprintf("record of at most %d bytes", maxRecordLength),
+			fmt.Sprintf("record %q of %d bytes", head[0], length), nil)
+	}
+	if cap(rr.buf) < int(length) {
+		rr.buf = make([]byte, length)
+	}
+	payload := rr.buf[:length]
+	if _, err := io.ReadFull(rr.r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = rr.malformed(fmt.Sprintf("%d bytes of record %q", length, head[0]), "", io.ErrUnexpectedEOF)
+		}
+		return 0, 0, nil, err
+	}
+	rr.off += int64(recordHeadLength) + int64(length)
+
+	if rr.h != nil && head[0] != RecordTrailer {
+		rr.h.Write(head[:])
+		rr.h.Write(payload)
+	}
+
+	return head[0], head[1], payload, nil
+}
+
+// malformed reports malformed input in the record read last.
+func (rr *recordReader) malformed(expected, found string, err error) error {
+	return &hyperlayer.SyntaxError{Offset: rr.pos, Record: rr.n, Expected: expected, Found: found, Err: err}
+}
+
+// streamTrailer closes a binary stream. Digest is the SHA-256 of all stream
+// bytes in front of the trailer record, starting with C_HEAD_V2. Blocks
+// counts records, while BlockCount of the header counts chunks: a record
+// holds a run of chunks up to the max extent size.
+type streamTrailer struct {
+	Blocks uint64 // write and zero records in the stream
+	Bytes  uint64 // block data bytes in the stream
+	Digest [sha256.Size]byte
+}
+
+func (t *streamTrailer) marshal() []byte {
+	b := make([]byte, trailerLength)
+	binary.BigEndian.PutUint64(b[0:], t.Blocks)
+	binary.BigEndian.PutUint64(b[8:], t.Bytes)
+	copy(b[16:], t.Digest[:])
+	return b
+}
+
+func (t *streamTrailer) unmarshal(b []byte) error {
+	if len(b) != trailerLength {
+		return errors.New("length of stream trailer is wrong")
+	}
+	t.Blocks = binary.BigEndian.Uint64(b[0:])
+	t.Bytes = binary.BigEndian.Uint64(b[8:])
+	copy(t.Digest[:], b[16:])
+	return nil
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func blockChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32c)
+}
+
+func encodeBaseBlocks(blocks []thindelta.BlockHash) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(len(blocks)))
+	for _, block := range blocks {
+		binary.Write(buf, binary.BigEndian, block.Offset)
+		binary.Write(buf, binary.BigEndian, block.Length)
+		putString(buf, block.HashType)
+		putString(buf, block.Value)
+	}
+	return buf.Bytes()
+}
+
+func decodeBaseBlocks(b []byte) ([]thindelta.BlockHash, error) {
+	buf := bytes.NewReader(b)
+
+	var count uint32
+	if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	blocks := []thindelta.BlockHash{}
+	for i := uint32(0); i < count; i++ {
+		block := thindelta.BlockHash{}
+		if err := binary.Read(buf, binary.BigEndian, &block.Offset); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &block.Length); err != nil {
+			return nil, err
+		}
+		var err error
+		if block.HashType, err = getString(buf); err != nil {
+			return nil, err
+		}
+		if block.Value, err = getString(buf); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	if buf.Len() != 0 {
+		return nil, errors.New("trailing data in base hash record")
+	}
+	return blocks, nil
+}
@@ -0,0 +1,298 @@
+package lvbackup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hyperblock/lvdiff/lvbackup/hyperlayer"
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
+)
+
+type testRecord struct {
+	typ, flags uint8
+	payload    [][]byte
+}
+
+func (r testRecord) joined() []byte {
+	return bytes.Join(r.payload, nil)
+}
+
+func testRecords() []testRecord {
+	h := streamHeader{SchemeVersion: StreamSchemeV2, StreamType: StreamTypeDelta, Name: "vol", BlockSize: 4096, Meta: []byte{}}
+	header, _ := h.MarshalBinary()
+	data := bytes.Repeat([]byte{7}, 4096)
+	write := make([]byte, writeHeadLength)
+	binary.BigEndian.PutUint64(write, 3*4096)
+	binary.BigEndian.PutUint32(write[8:], blockChecksum(data))
+	zero := make([]byte, zeroRecordLength)
+	binary.BigEndian.PutUint64(zero, 8*4096)
+	binary.BigEndian.PutUint64(zero[8:], 2*4096)
+	trailer := &streamTrailer{Blocks: 2, Bytes: 4096}
+	sig := &streamSignature{Kind: SigTrailer}
+
+	return []testRecord{
+		{RecordHeader, 0, [][]byte{header}},
+		{RecordBaseHash, 0, [][]byte{encodeBaseBlocks([]thindelta.BlockHash{{Offset: 0, Length: 8, HashType: "CRC32", Value: "1234abcd"}})}},
+		{RecordWrite, 0, [][]byte{write, data}},
+		{RecordWrite, FlagCompressed, [][]byte{write, {0, 0, 0x10, 0}, []byte("compressed")}},
+		{RecordZero, 0, [][]byte{zero}},
+		{RecordIndex, 0, [][]byte{encodeIndex([]IndexEntry{{Type: RecordWrite, Offset: 3 * 4096, Length: 4096, Pos: 100, Seq: 1}})}},
+		{RecordTrailer, 0, [][]byte{trailer.marshal()}},
+		{RecordSignature, 0, [][]byte{sig.marshal()}},
+		{RecordEnd, 0, nil},
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := testRecords()
+	var buf bytes.Buffer
+	for _, r := range records {
+		if err := writeRecord(&buf, r.typ, r.flags, r.payload...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := recordReader{r: &buf, off: int64(len(C_HEAD_V2))}
+	off := rr.off
+	for i, r := range records {
+		typ, flags, payload, err := rr.next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if typ != r.typ || flags != r.flags || !bytes.Equal(payload, r.joined()) {
+			t.Errorf("record %d: got %q flags %#x of %d bytes, want %q flags %#x of %d bytes",
+				i, typ, flags, len(payload), r.typ, r.flags, len(r.joined()))
+		}
+		if rr.pos != off || rr.n != uint64(i+1) {
+			t.Errorf("record %d: at offset %d as record %d, want offset %d", i, rr.pos, rr.n, off)
+		}
+		off += int64(recordHeadLength + len(payload))
+	}
+	if _, _, _, err := rr.next(); err != io.EOF {
+		t.Fatalf("got %v behind the last record, want io.EOF", err)
+	}
+	if rr.n != uint64(len(records)) {
+		t.Errorf("%d records counted, want %d", rr.n, len(records))
+	}
+
+	// the payloads decode to what was marshaled
+	var h streamHeader
+	if err := h.UnmarshalBinary(records[0].joined()); err != nil || h.Name != "vol" {
+		t.Errorf("header record: %+v, %v", h, err)
+	}
+	if blocks, err := decodeBaseBlocks(records[1].joined()); err != nil || len(blocks) != 1 || blocks[0].Value != "1234abcd" {
+		t.Errorf("base hash record: %+v, %v", blocks, err)
+	}
+	if entries, err := decodeIndex(records[5].joined()); err != nil || len(entries) != 1 || entries[0].Pos != 100 {
+		t.Errorf("index record: %+v, %v", entries, err)
+	}
+	var tr streamTrailer
+	if err := tr.unmarshal(records[6].joined()); err != nil || tr.Blocks != 2 || tr.Bytes != 4096 {
+		t.Errorf("trailer record: %+v, %v", tr, err)
+	}
+	var sig streamSignature
+	if err := sig.unmarshal(records[7].joined()); err != nil || sig.Kind != SigTrailer {
+		t.Errorf("signature record: %+v, %v", sig, err)
+	}
+}
+
+func TestRecordRejects(t *testing.T) {
+	var buf bytes.Buffer
+	writeRecord(&buf, RecordZero, 0, make([]byte, zeroRecordLength))
+	zero := buf.Bytes()
+	huge := []byte{RecordWrite, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(huge[2:], maxRecordLength+1)
+
+	cases := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"record too large", huge, nil},
+		{"truncated head", zero[:3], io.ErrUnexpectedEOF},
+		{"truncated payload", zero[:recordHeadLength+5], io.ErrUnexpectedEOF},
+		{"payload missing", zero[:recordHeadLength], io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		// a good record in front, so the error has to locate the second one
+		stream := append(append([]byte{}, zero...), c.stream...)
+		rr := recordReader{r: bytes.NewReader(stream), off: int64(len(C_HEAD_V2))}
+		if _, _, _, err := rr.next(); err != nil {
+			t.Fatalf("%s: first record: %v", c.name, err)
+		}
+		_, _, _, err := rr.next()
+		var se *hyperlayer.SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: got %v, want a syntax error", c.name, err)
+			continue
+		}
+		if se.Offset != int64(len(C_HEAD_V2)+len(zero)) || se.Record != 2 {
+			t.Errorf("%s: %v, want offset %d record 2", c.name, err, len(C_HEAD_V2)+len(zero))
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	// 1025 MiB of payload, without allocating it
+	mib := make([]byte, 1<<20)
+	payload := make([][]byte, 1025)
+	for i := range payload {
+		payload[i] = mib
+	}
+	var out bytes.Buffer
+	if err := writeRecord(&out, RecordWrite, 0, payload...); err == nil || out.Len() != 0 {
+		t.Errorf("record larger than the limit written: %v", err)
+	}
+}
+
+func TestStreamMagic(t *testing.T) {
+	for _, magic := range []string{"HYPERLAYER/3.0\n", "HYPERLAYER/2.0 \n", "hyperlayer/2.0\n", "\n"} {
+		_, err := newStreamDecoder(bufio.NewReader(strings.NewReader(magic+"H")), nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "unknown stream format") {
+			t.Errorf("magic %q: got %v", magic, err)
+		}
+	}
+	if _, err := newStreamDecoder(bufio.NewReader(strings.NewReader("HYPERLAYER/2.0")), nil, nil); err != io.EOF {
+		t.Errorf("magic without newline: got %v, want io.EOF", err)
+	}
+	for _, magic := range []string{C_HEAD, C_HEAD_V2} {
+		if _, err := newStreamDecoder(bufio.NewReader(strings.NewReader(magic)), nil, nil); err != nil {
+			t.Errorf("magic %q: %v", magic, err)
+		}
+	}
+}
+
+// writeTestStream writes a v2 stream of the given blocks of 4096 bytes,
+// data or nil for a zero record, keyed by chunk.
+func writeTestStream(t *testing.T, setup func(s *streamSender), blocks map[int64][]byte) []byte {
+	var out bytes.Buffer
+	s, err := NewStreamSender("vg", "lv", "", &out, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetScheme(StreamSchemeV2); err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(s)
+	}
+	s.header = streamHeader{SchemeVersion: StreamSchemeV2, StreamType: StreamTypeDelta, Name: "lv", VolumeSize: 1 << 20, BlockSize: 4096, Compression: s.compress}
+	if err := s.putHeader(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putBaseBlocks(nil); err != nil {
+		t.Fatal(err)
+	}
+	for chunk := int64(0); chunk < 256; chunk++ {
+		data, ok := blocks[chunk]
+		if !ok {
+			continue
+		}
+		if data == nil {
+			err = s.putZero(chunk*4096, 4096)
+		} else {
+			err = s.putBlock(chunk, 4096, data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.putEnd(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// readTestStream decodes a stream, returning the blocks read up to the
+// first error, data copied.
+func readTestStream(stream []byte, key *StreamKey, verifier *streamVerifier) ([]streamBlock, error) {
+	dec, err := newStreamDecoder(bufio.NewReader(bytes.NewReader(stream)), key, verifier)
+	if err != nil {
+		return nil, err
+	}
+	var h streamHeader
+	if err := dec.readHeader(&h); err != nil {
+		return nil, err
+	}
+	if _, err := dec.readBaseBlocks(&h); err != nil {
+		return nil, err
+	}
+	if err := dec.verifyHeader(); err != nil {
+		return nil, err
+	}
+	var blocks []streamBlock
+	for {
+		b, err := dec.nextBlock()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return blocks, err
+		}
+		if b.Data != nil {
+			b.Data = append([]byte{}, b.Data...)
+		}
+		blocks = append(blocks, b)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	stream := writeTestStream(t, nil, map[int64][]byte{1: bytes.Repeat([]byte{1}, 4096), 5: nil})
+	if blocks, err := readTestStream(stream, nil, nil); err != nil || len(blocks) != 2 {
+		t.Fatalf("%d blocks, %v", len(blocks), err)
+	}
+	// every cut short of the end record fails
+	end := len(stream) - footerLength - recordHeadLength
+	for n := len(C_HEAD_V2); n < end; n++ {
+		if _, err := readTestStream(stream[:n], nil, nil); err == nil {
+			t.Fatalf("stream cut to %d of %d bytes accepted", n, len(stream))
+		}
+	}
+}
+
+func TestStreamTrailer(t *testing.T) {
+	blocks := map[int64][]byte{1: bytes.Repeat([]byte{1}, 4096), 2: bytes.Repeat([]byte{2}, 4096), 5: nil}
+	stream := writeTestStream(t, nil, blocks)
+	if got, err := readTestStream(stream, nil, nil); err != nil || len(got) != 3 {
+		t.Fatalf("%d blocks, %v", len(got), err)
+	}
+	// the stream ends with the trailer, end record and footer
+	end := len(stream) - footerLength - recordHeadLength
+	trailer := end - recordHeadLength - trailerLength
+
+	digest := append([]byte{}, stream...)
+	digest[end-1] ^= 1
+	noTrailer := append(append([]byte{}, stream[:trailer]...), stream[end:]...)
+
+	// a trailer with a correct digest over a wrong count
+	var out bytes.Buffer
+	s, _ := NewStreamSender("vg", "lv", "", &out, 0)
+	s.SetScheme(StreamSchemeV2)
+	s.header = streamHeader{SchemeVersion: StreamSchemeV2, StreamType: StreamTypeDelta, BlockSize: 4096, BlockCount: 2}
+	s.putHeader(nil)
+	s.putBaseBlocks(nil)
+	s.putExtent(1, 4096, bytes.Repeat([]byte{1}, 2*4096))
+	s.written++
+	s.putEnd()
+
+	cases := []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{"bad digest", digest, "stream digest mismatch"},
+		{"missing trailer", noTrailer, "stream truncated: no trailer"},
+		{"record count", out.Bytes(), "stream trailer mismatch: 2 records (8192 bytes) expected, 1 records (8192 bytes) received"},
+	}
+	for _, c := range cases {
+		if _, err := readTestStream(c.stream, nil, nil); err == nil || err.Error() != c.err {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -1,26 +1,34 @@
 package lvbackup
 
 import (
-	"crypto/md5"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/hyperblock/lvdiff/lvbackup/lvmutil"
 	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
 	"github.com/hyperblock/lvdiff/lvbackup/vgcfg"
 
 	"github.com/ncw/directio"
-	yaml "gopkg.in/yaml.v2"
-
-	"strings"
 
 	"bufio"
 )
 
+// IncompleteTag marks the temporary snapshot lvpatch writes into. It is
+// renamed to the new volume only once the whole stream has been verified.
+const IncompleteTag = "lvpatch_incomplete"
+
+func tempLvName(lvname string) string {
+	return lvname + "_lvpatch"
+}
+
 type streamRecver struct {
 	vgname       string
 	poolname     string
@@ -32,8 +40,35 @@ type streamRecver struct {
 
 	baseBlocks []thindelta.BlockHash
 
+	key      *StreamKey
+	verifier *streamVerifier
+
+	// writers hold mu for reading; checkpoints and the rollback on a
+	// signal hold it for writing
+	mu     sync.RWMutex
+	dev    *os.File
+	jobs   int    // writer goroutines
+	tempLv string // temporary snapshot to remove on failure, empty once committed
+
+	replaceLv string // thin lv the temporary one replaces on commit
+
+	targetFile string // raw image to patch instead of a thin lv
+	baseFile   string // base image of a delta stream
+	tempFile   string // temporary image to remove on failure, empty once committed
+
+	statePath string      // state file of --resume, empty if not resumable
+	state     *patchState // nil if not resumable
+	applied   uint64      // blocks of the stream applied so far
+	digest    [sha256.Size]byte
+	unsaved   int64 // block bytes written since the last checkpoint
+
+	verify  bool
+	written []writtenBlock // blocks to read back if verify is set
+
+	dryRun  bool
+	inPlace string // thin lv to patch without a snapshot
+
 	r io.Reader
-	h hash.Hash
 }
 
 func NewStreamRecver(vgname, poolname, lvname string, flg bool, r io.Reader) (*streamRecver, error) {
@@ -42,8 +77,8 @@ func NewStreamRecver(vgname, poolname, lvname string, flg bool, r io.Reader) (*s
 		poolname:     poolname,
 		lvname:       lvname,
 		disableCheck: flg,
+		jobs:         DefaultJobs,
 		r:            r,
-		h:            md5.New(),
 	}, nil
 }
 
@@ -65,6 +100,48 @@ func print_ProcessBar(current, total int64) string {
 	return ret
 }
 
+// SetDecryption gives the key of encrypted streams.
+func (sr *streamRecver) SetDecryption(k *StreamKey) {
+	sr.key = k
+}
+
+// SetVerification checks stream signatures against the trusted keys. If
+// require is set, unsigned streams are refused. sigFile names a file of
+// detached signatures and may be empty.
+func (sr *streamRecver) SetVerification(keys []ed25519.PublicKey, require bool, sigFile string) error {
+	v := &streamVerifier{keys: keys, require: require}
+	if len(sigFile) > 0 {
+		if err := v.loadDetached(sigFile); err != nil {
+			return err
+		}
+	}
+	sr.verifier = v
+	return nil
+}
+
+// SetJobs sets the number of goroutines writing to the target.
+func (sr *streamRecver) SetJobs(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid number of jobs %d", n)
+	}
+	sr.jobs = n
+	return nil
+}
+
+// SetVerify reads back every written block once the stream has been
+// applied and compares it with the stream data.
+func (sr *streamRecver) SetVerify(verify bool) {
+	sr.verify = verify
+}
+
+// SetResume makes the patch resumable. The progress is checkpointed to
+// the state file at path; on failure the target volume is kept, and a
+// later run with the same stream and state file continues where this one
+// stopped.
+func (sr *streamRecver) SetResume(path string) {
+	sr.statePath = path
+}
+
 func (sr *streamRecver) prepare() error {
 
 	// check whether block size of pool match with the stream
@@ -73,6 +150,31 @@ func (sr *streamRecver) prepare() error {
 	if err != nil {
 		return err
 	}
+	if sr.state != nil {
+		return sr.prepareResume(root)
+	}
+	if len(sr.inPlace) > 0 {
+		return sr.prepareInPlace(root)
+	}
+	if sr.header.StreamType == StreamTypeFull && len(sr.poolname) > 0 {
+		return sr.prepareNewLv(root)
+	}
+	if sr.header.StreamType == StreamTypeFull {
+		return sr.prepareFull(root)
+	}
+	if len(sr.poolname) > 0 {
+		return errors.New("a new thin lv can only be created for a full stream")
+	}
+	if len(sr.lvname) == 0 {
+		return errors.New("base logical volume is required for a delta stream")
+	}
+	if _, ok := root.FindThinLv(sr.header.Name); ok {
+		return fmt.Errorf("thin lv %s already exists", sr.header.Name)
+	}
+	tempLv := tempLvName(sr.header.Name)
+	if _, ok := root.FindThinLv(tempLv); ok {
+		return fmt.Errorf("thin lv %s of an earlier lvpatch exists, remove it first", tempLv)
+	}
 	baseLv, ok := root.FindThinLv(sr.lvname)
 	if !ok {
 		return errors.New("can not find thin lv " + sr.lvname)
@@ -86,8 +188,13 @@ func (sr *streamRecver) prepare() error {
 		return errors.New("block size does not match with that of local pool")
 	}
 
+	baseSize := uint64(baseLv.ExtentCount) * uint64(root.ExtentSize())
 	if sr.disableCheck == false {
 
+		if sr.header.BaseSize != 0 && sr.header.BaseSize != baseSize {
+			return fmt.Errorf("size of base lv %s is %d bytes, the stream expects %d bytes", sr.lvname, baseSize, sr.header.BaseSize)
+		}
+
 		devPath := lvmutil.LvDevicePath(sr.vgname, sr.lvname)
 		ok, err := thindelta.CheckBase(devPath, pool.ChunkSize, sr.baseBlocks)
 		if err != nil {
@@ -99,174 +206,469 @@ func (sr *streamRecver) prepare() error {
 			return fmt.Errorf("checksum incorrect.")
 		}
 	}
+	if sr.dryRun {
+		return sr.checkPoolSpace(pool)
+	}
 
 	//create a snapshot
-	fmt.Printf("Create Snapshot volume. (%s)\n", sr.header.Name)
-	if err := lvmutil.CreateSnapshotLv(sr.vgname, sr.lvname, sr.header.Name); err != nil {
-		return errors.New("can not create snapshotLv: " + sr.header.Name + " " + err.Error())
+	fmt.Printf("Create Snapshot volume. (%s)\n", tempLv)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if err := lvmutil.CreateSnapshotLv(sr.vgname, sr.lvname, tempLv); err != nil {
+		return errors.New("can not create snapshotLv: " + tempLv + " " + err.Error())
+	}
+	sr.tempLv = tempLv
+	sr.lvname = tempLv
+	if err := lvmutil.AddLvTag(sr.vgname, tempLv, IncompleteTag); err != nil {
+		return err
 	}
-	sr.lvname = sr.header.Name
+	return sr.resizeTarget(baseSize)
+}
 
-	return nil
+// prepareNewLv creates the target of a full stream in sr.poolname. Like
+// the snapshot of a delta stream, it is created under a temporary name
+// and renamed once the stream has been verified.
+func (sr *streamRecver) prepareNewLv(root *vgcfg.Group) error {
+	pool, ok := root.FindThinPool(sr.poolname)
+	if !ok {
+		return errors.New("can not find thin pool " + sr.poolname)
+	}
+	if pool.ChunkSize != int64(sr.header.BlockSize) {
+		return errors.New("block size does not match with that of local pool")
+	}
+	if _, ok := root.FindThinLv(sr.header.Name); ok {
+		return fmt.Errorf("thin lv %s already exists", sr.header.Name)
+	}
+	tempLv := tempLvName(sr.header.Name)
+	if _, ok := root.FindThinLv(tempLv); ok {
+		return fmt.Errorf("thin lv %s of an earlier lvpatch exists, remove it first", tempLv)
+	}
+	if sr.dryRun {
+		return sr.checkPoolSpace(pool)
+	}
+
+	fmt.Printf("Create thin volume. (%s, %d bytes in %s)\n", tempLv, sr.header.VolumeSize, sr.poolname)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if err := lvmutil.CreateThinLv(sr.vgname, sr.poolname, tempLv, int64(sr.header.VolumeSize)); err != nil {
+		return errors.New("can not create thin lv: " + tempLv + " " + err.Error())
+	}
+	sr.tempLv = tempLv
+	sr.lvname = tempLv
+	return lvmutil.AddLvTag(sr.vgname, tempLv, IncompleteTag)
 }
 
-func (sr *streamRecver) readHeader(bfRd *bufio.Reader) error {
+// resizeTarget brings the target, which is size bytes now, to the volume
+// size of the stream, so that no block is written past its end.
+func (sr *streamRecver) resizeTarget(size uint64) error {
+	switch {
+	case sr.header.VolumeSize == 0 || sr.header.VolumeSize == size:
+		return nil
+	case sr.header.VolumeSize > size:
+		fmt.Printf("Grow volume %s from %d to %d bytes.\n", sr.lvname, size, sr.header.VolumeSize)
+		return lvmutil.ResizeLv(sr.vgname, sr.lvname, int64(sr.header.VolumeSize), false)
+	}
+	// the source volume has been shrunk since the base was taken
+	fmt.Printf("Shrink volume %s from %d to %d bytes.\n", sr.lvname, size, sr.header.VolumeSize)
+	return lvmutil.ResizeLv(sr.vgname, sr.lvname, int64(sr.header.VolumeSize), true)
+}
 
-	headBuff := []byte{}
-	index := 0
-	for {
-		pair, err := bfRd.ReadBytes('\n')
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-		if pair[0] == 0xa {
-			break
-		}
-		if index > 0 {
-			headBuff = append(headBuff, pair[0:]...)
-		}
-		fmt.Fprintf(os.Stderr, "%s", string(pair))
-		index++
+// prepareResume continues writing into the target of an interrupted run.
+func (sr *streamRecver) prepareResume(root *vgcfg.Group) error {
+	lv, ok := root.FindThinLv(sr.state.Target)
+	if !ok {
+		return fmt.Errorf("thin lv %s of the state file does not exist", sr.state.Target)
+	}
+	// a volume committed or abandoned since is not written into again
+	if !hasTag(lv.Tags, IncompleteTag) {
+		return fmt.Errorf("thin lv %s of the state file is not tagged %s, it is not being patched", lv.Name, IncompleteTag)
+	}
+	pool, ok := root.FindThinPool(lv.Pool)
+	if !ok {
+		return errors.New("can not find thin pool " + lv.Pool)
+	}
+	if pool.ChunkSize != int64(sr.header.BlockSize) {
+		return errors.New("block size does not match with that of local pool")
 	}
 
-	err := yaml.Unmarshal(headBuff, &sr.header)
-	if err != nil {
-		return err
+	fmt.Printf("Resume patching. (%s, %d blocks applied)\n", lv.Name, sr.state.Blocks)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if lv.Name != sr.header.Name {
+		sr.tempLv = lv.Name
+		// the target of a full stream the user created beforehand
+		if _, ok := root.FindThinLv(sr.header.Name); ok && sr.header.StreamType == StreamTypeFull {
+			sr.replaceLv = sr.header.Name
+		}
 	}
+	sr.lvname = lv.Name
 	return nil
-
 }
 
-func (sr *streamRecver) readBaseBlocks(bfRd *bufio.Reader) error {
-
-	if sr.header.DetectLevel == 0 {
-		return nil
+// commit renames the temporary snapshot or image to the new volume and
+// tags a volume with its lineage.
+func (sr *streamRecver) commit() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if err := sr.closeDev(); err != nil {
+		return err
 	}
-	for {
-		buf, err := bfRd.ReadBytes('\n')
-		if err != nil {
-			fmt.Println(err.Error())
+	if len(sr.tempFile) > 0 {
+		if err := os.Rename(sr.tempFile, sr.targetFile); err != nil {
 			return err
 		}
-		if buf[0] == 0xa {
-			break
+		sr.tempFile = ""
+		sr.lvname = sr.targetFile
+		return sr.finishState()
+	}
+	if len(sr.tempLv) > 0 {
+		if err := lvmutil.DelLvTag(sr.vgname, sr.tempLv, IncompleteTag); err != nil {
+			return err
 		}
-		tokens := strings.Split(string(buf), " ")
-		offset, err := strconv.ParseInt(tokens[1], 16, 64)
-		if err != nil {
+		if len(sr.replaceLv) > 0 {
+			fmt.Printf("Remove replaced volume. (%s)\n", sr.replaceLv)
+			if err := lvmutil.RemoveLv(sr.vgname, sr.replaceLv, true); err != nil {
+				return err
+			}
+			sr.replaceLv = ""
+		}
+		if err := lvmutil.RenameLv(sr.vgname, sr.tempLv, sr.header.Name); err != nil {
 			return err
 		}
-		length, err := strconv.ParseInt(tokens[2], 16, 64)
-		if err != nil {
+		sr.tempLv = ""
+		sr.lvname = sr.header.Name
+	} else if len(sr.inPlace) > 0 {
+		if err := lvmutil.DelLvTag(sr.vgname, sr.lvname, IncompleteTag); err != nil {
 			return err
 		}
-		baseBlock := thindelta.BlockHash{
-			Offset:   offset,
-			Length:   length,
-			HashType: tokens[3],
-			Value:    tokens[4][:len(tokens[4])-1],
+	}
+	if err := sr.setLineage(); err != nil {
+		return err
+	}
+	return sr.finishState()
+}
+
+// finishState removes the state file once the patch is complete.
+func (sr *streamRecver) finishState() error {
+	if sr.state == nil {
+		return nil
+	}
+	sr.state = nil
+	return os.Remove(sr.statePath)
+}
+
+// rollback removes the temporary snapshot or image, if any. A resumable
+// patch keeps it and checkpoints the progress instead.
+func (sr *streamRecver) rollback() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.state != nil {
+		if err := sr.checkpoint(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		sr.closeDev()
+		fmt.Fprintf(os.Stderr, "Keep volume %s, continue with --resume %s\n", sr.lvname, sr.statePath)
+		return
+	}
+	sr.closeDev()
+	if len(sr.inPlace) > 0 && sr.lvname == sr.inPlace {
+		sr.abandonInPlace()
+		return
+	}
+	if len(sr.tempFile) > 0 {
+		fmt.Fprintf(os.Stderr, "Remove temporary image. (%s)\n", sr.tempFile)
+		if err := os.Remove(sr.tempFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
 		}
-		sr.baseBlocks = append(sr.baseBlocks, baseBlock)
+		sr.tempFile = ""
+		return
 	}
-	//	fmt.Println(sr.baseBlocks)
-	return nil
+	if len(sr.tempLv) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Remove temporary volume. (%s)\n", sr.tempLv)
+	if err := lvmutil.RemoveLv(sr.vgname, sr.tempLv, true); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	sr.tempLv = ""
+}
+
+// checkpoint syncs the target and saves the progress to the state file.
+// sr.mu must be held.
+func (sr *streamRecver) checkpoint() error {
+	if sr.applied < sr.state.Blocks {
+		// still skipping what an earlier run applied
+		return nil
+	}
+	if sr.dev != nil {
+		if err := sr.dev.Sync(); err != nil {
+			return err
+		}
+	}
+	sr.state.Blocks = sr.applied
+	sr.state.Digest = hex.EncodeToString(sr.digest[:])
+	sr.unsaved = 0
+	return sr.state.save(sr.statePath)
+}
+
+// closeDev syncs and closes the target device. sr.mu must be held.
+func (sr *streamRecver) closeDev() error {
+	if sr.dev == nil {
+		return nil
+	}
+	err := sr.dev.Sync()
+	if cerr := sr.dev.Close(); err == nil {
+		err = cerr
+	}
+	sr.dev = nil
+	return err
+}
+
+// prepareFull checks the target of a full stream, a thin lv named after
+// the new volume which the user has created beforehand. There is no base
+// volume: the stream is written into a new thin lv in the pool of the
+// target, which replaces the target once the stream has been verified, so
+// no chunk of its old content is left and a failed run leaves it as it is.
+func (sr *streamRecver) prepareFull(root *vgcfg.Group) error {
+	lv, ok := root.FindThinLv(sr.header.Name)
+	if !ok {
+		return fmt.Errorf("can not find thin lv %s, create it before restoring a full stream", sr.header.Name)
+	}
+	pool, ok := root.FindThinPool(lv.Pool)
+	if !ok {
+		return errors.New("can not find thin pool " + lv.Pool)
+	}
+	if pool.ChunkSize != int64(sr.header.BlockSize) {
+		return errors.New("block size does not match with that of local pool")
+	}
+	tempLv := tempLvName(sr.header.Name)
+	if _, ok := root.FindThinLv(tempLv); ok {
+		return fmt.Errorf("thin lv %s of an earlier lvpatch exists, remove it first", tempLv)
+	}
+	if sr.dryRun {
+		return sr.checkPoolSpace(pool)
+	}
+
+	// a larger volume of the user keeps its size
+	size := uint64(lv.ExtentCount) * uint64(root.ExtentSize())
+	if size < sr.header.VolumeSize {
+		size = sr.header.VolumeSize
+	}
+	fmt.Printf("Restore full stream. (%s, replacing %s)\n", tempLv, sr.header.Name)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if err := lvmutil.CreateThinLv(sr.vgname, lv.Pool, tempLv, int64(size)); err != nil {
+		return errors.New("can not create thin lv: " + tempLv + " " + err.Error())
+	}
+	sr.tempLv = tempLv
+	sr.lvname = tempLv
+	sr.replaceLv = sr.header.Name
+	return lvmutil.AddLvTag(sr.vgname, tempLv, IncompleteTag)
 }
 
 func (sr *streamRecver) recvDiffStream(newLv string) error {
 
 	bfRd := bufio.NewReader(sr.r)
-	sr.readHeader(bfRd)
-	sr.header.Name = newLv
-	sr.readBaseBlocks(bfRd)
-
-	if err := sr.prepare(); err != nil {
+	dec, err := newStreamDecoder(bfRd, sr.key, sr.verifier)
+	if err != nil {
 		return err
 	}
-
-	err := lvmutil.ActivateLv(sr.vgname, sr.lvname)
+	if err := dec.readHeader(&sr.header); err != nil {
+		return err
+	}
+	// the pool checks the chunk size of a volume target, nothing checks
+	// that of a file
+	if len(sr.targetFile) > 0 && (sr.header.BlockSize == 0 || sr.header.BlockSize%4096 != 0) {
+		return fmt.Errorf("chunk size %d of the stream is not a multiple of 4096", sr.header.BlockSize)
+	}
+	// streams older than the volume size may be patched into volumes,
+	// which have a size of their own
+	if len(sr.targetFile) > 0 && sr.header.VolumeSize == 0 {
+		return errors.New("stream has no volume size, it can not be patched into a file")
+	}
+	identity, err := streamIdentity(&sr.header)
 	if err != nil {
 		return err
 	}
-	//return nil
-	//defer lvmutil.DeactivateLv(sr.vgname, sr.lvname)
-	//defer lvmutil.ActivateLv(sr.vgname, sr.header.Name)
-	devpath := lvmutil.LvDevicePath(sr.vgname, sr.lvname)
+	sr.header.Name = newLv
+	if sr.baseBlocks, err = dec.readBaseBlocks(&sr.header); err != nil {
+		return err
+	}
+	if err := dec.verifyHeader(); err != nil {
+		return err
+	}
+
+	if len(sr.statePath) > 0 && !sr.dryRun {
+		if sr.state, err = loadPatchState(sr.statePath); err != nil {
+			return err
+		}
+		if sr.state != nil && (sr.state.Stream != identity || sr.state.Volume != newLv) {
+			return fmt.Errorf("state file %s belongs to another stream or volume", sr.statePath)
+		}
+	}
 
-	devFile, err := directio.OpenFile(devpath, os.O_WRONLY, 0644)
+	if len(sr.targetFile) > 0 {
+		err = sr.prepareImage()
+	} else {
+		err = sr.prepare()
+	}
 	if err != nil {
 		return err
 	}
-	defer devFile.Close()
+	if sr.dryRun {
+		return sr.dryRunBlocks(dec)
+	}
 
-	total := int64(sr.header.BlockCount)
-	dwWritten := int64(0)
-	//	fmt.Println(total)
-	fmt.Println("start patching...")
-	for {
+	if len(sr.statePath) > 0 && sr.state == nil {
+		st := &patchState{Stream: identity, Volume: newLv, Target: sr.lvname, Digest: hex.EncodeToString(sr.digest[:])}
+		if err := st.save(sr.statePath); err != nil {
+			return err
+		}
+		sr.mu.Lock()
+		sr.state = st
+		sr.mu.Unlock()
+	}
+	skip := uint64(0)
+	if sr.state != nil {
+		skip = sr.state.Blocks
+	}
 
-		line, err := bfRd.ReadBytes('\n')
-		//fmt.Println(string(subHead))
+	var devFile *os.File
+	if len(sr.targetFile) > 0 {
+		devFile, err = os.OpenFile(sr.lvname, os.O_RDWR, 0644)
+	} else {
+		err = lvmutil.ActivateLv(sr.vgname, sr.lvname)
 		if err != nil {
-
 			return err
 		}
-		subHead := string(line[:len(line)-1])
+		//return nil
+		//defer lvmutil.DeactivateLv(sr.vgname, sr.lvname)
+		//defer lvmutil.ActivateLv(sr.vgname, sr.header.Name)
+		devpath := lvmutil.LvDevicePath(sr.vgname, sr.lvname)
 
-		args := strings.Split(subHead, " ")
-		if len(args) != 3 {
-			break
-		}
-		offset, _ := strconv.ParseInt(args[1], 16, 64)
-		length, _ := strconv.ParseInt(args[2], 16, 64)
-		length <<= 9
-		offset <<= 9
-
-		tmpbuf := make([]byte, length)
-		buf := make([]byte, length)
-		var cnt int64
-		for {
-			n, err := bfRd.Read(tmpbuf)
-			if err != nil {
-				return err
-			}
-			copy(buf[cnt:], tmpbuf)
-			cnt += int64(n)
-			if cnt >= length {
-				break
-			}
-			tmpbuf = make([]byte, length-cnt)
-		}
+		// zero records read the range back after discarding it
+		devFile, err = directio.OpenFile(devpath, os.O_RDWR, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	sr.mu.Lock()
+	sr.dev = devFile
+	sr.mu.Unlock()
 
-		if _, err := devFile.Seek(offset, os.SEEK_SET); err != nil {
-			fmt.Println("seek error.")
+	//	fmt.Println(total)
+	fmt.Println("start patching...")
+	if err := sr.applyBlocks(dec, skip); err != nil {
+		return err
+	}
+	if sr.verify {
+		if err := sr.verifyBlocks(); err != nil {
 			return err
 		}
-		if _, err := devFile.Write(buf); err != nil {
-			fmt.Println("dev write error.")
+	}
+
+	//	sr.prevUUID = string(sr.header.VolumeUUID[:])
+	return sr.commit()
+}
+
+// writeBlock writes block to the target. It may run in several goroutines.
+func (sr *streamRecver) writeBlock(block streamBlock, zeroBuf []byte) error {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	if sr.dev == nil {
+		return errors.New("target volume is closed")
+	}
+	if sr.header.VolumeSize > 0 && uint64(block.Offset+block.Length) > sr.header.VolumeSize {
+		return fmt.Errorf("block at offset %d is beyond the volume size %d", block.Offset, sr.header.VolumeSize)
+	}
+
+	if block.Data == nil {
+		if err := zeroRange(sr.dev, block.Offset, block.Length, zeroBuf); err != nil {
+			fmt.Println("dev zero error.")
 			return err
 		}
-		dwWritten++
-		//fmt.Println(dwWritten)
-		bfRd.ReadBytes('\n')
-		bar := print_ProcessBar(dwWritten, total)
-		fmt.Printf("\rPatch blocks %s", bar)
+		return nil
+	}
+	if _, err := sr.dev.WriteAt(block.Data, block.Offset); err != nil {
+		fmt.Println("dev write error.")
+		return err
 	}
-	fmt.Println("\ndone")
+	return nil
+}
 
-	//	sr.prevUUID = string(sr.header.VolumeUUID[:])
+// skipBlock passes over a block applied by an earlier run, checking that
+// the stream is the same one.
+func (sr *streamRecver) skipBlock(block streamBlock) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.digest = chainDigest(sr.digest, block, blockDigest(block))
+	sr.applied++
+	if sr.verify {
+		sr.written = append(sr.written, newWrittenBlock(block))
+	}
+	if sr.applied == sr.state.Blocks && hex.EncodeToString(sr.digest[:]) != sr.state.Digest {
+		return errors.New("stream does not match the blocks applied by the earlier run")
+	}
+	return nil
+}
+
+// account accounts for the block of job once it and all blocks in front
+// of it have been written.
+func (sr *streamRecver) account(job *writeJob) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.applied++
+	if sr.verify {
+		sr.written = append(sr.written, job.wb)
+	}
+	if sr.state == nil {
+		return nil
+	}
+	sr.digest = chainDigest(sr.digest, job.block, job.sum)
+	sr.unsaved += job.block.Length
+	if sr.unsaved >= checkpointBytes {
+		return sr.checkpoint()
+	}
 	return nil
 }
 
+// Run patches the stream into newLv. A delta stream is written into a
+// temporary snapshot, which is removed if anything fails or lvpatch is
+// interrupted, so newLv only appears once the stream has been verified.
 func (sr *streamRecver) Run(newLv string) error {
 	var err error
+
+	sigc := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-sigc:
+			fmt.Fprintf(os.Stderr, "\n%v received.\n", sig)
+			sr.rollback()
+			os.Exit(3)
+		case <-done:
+		}
+	}()
+
 	//bfRd := bufio.NewReader(sr.r)
 	//for {
 	err = sr.recvDiffStream(newLv)
+	if err != nil {
+		sr.rollback()
+	}
 
+	// recvDiffStream returns nil once the whole stream is received, a bare
+	// EOF means that the stream was cut off.
 	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
 		fmt.Println("\nDone.")
-		err = nil
 	}
 	return err
 }
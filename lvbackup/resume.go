@@ -0,0 +1,130 @@
+package lvbackup
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// checkpointBytes is how much block data is written between two
+// checkpoints of the patch state.
+const checkpointBytes = 256 << 20
+
+// patchState is the checkpoint of an interrupted lvpatch, kept in the
+// state file given by --resume. The blocks of the stream up to Blocks have
+// been written to Target and synced; Digest chains them, so a resumed run
+// can tell that it is reading the same stream.
+type patchState struct {
+	Stream string `yaml:"Stream"` // SHA-256 of the stream header
+	Volume string `yaml:"Volume"` // new volume name
+	Target string `yaml:"Target"` // thin lv the stream is written into
+	Blocks uint64 `yaml:"Applied blocks"`
+	Digest string `yaml:"Digest"`
+}
+
+// loadPatchState reads a state file. It returns nil if the file does not
+// exist.
+func loadPatchState(path string) (*patchState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &patchState{}
+	if err := yaml.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// save replaces the state file atomically.
+func (st *patchState) save(path string) error {
+	data, err := yaml.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// writeFileAtomic replaces the file at path with data: it is written to a
+// temporary file, synced and renamed over the old one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// syncDir syncs the directory holding path, which makes renames into it
+// durable.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// streamIdentity identifies a stream by its header, which holds the
+// volume UUIDs and, for encrypted streams, a random salt.
+func streamIdentity(h *streamHeader) (string, error) {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// blockDigest is the SHA-256 of the data of block, zero for a zero range.
+func blockDigest(block streamBlock) [sha256.Size]byte {
+	if block.Data == nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(block.Data)
+}
+
+// chainDigest returns the rolling digest after block, whose blockDigest is
+// sum, has been applied.
+func chainDigest(prev [sha256.Size]byte, block streamBlock, sum [sha256.Size]byte) [sha256.Size]byte {
+	var pos [16]byte
+	binary.BigEndian.PutUint64(pos[0:], uint64(block.Offset))
+	binary.BigEndian.PutUint64(pos[8:], uint64(block.Length))
+
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write(pos[:])
+	if block.Data != nil {
+		h.Write([]byte{RecordWrite})
+	} else {
+		h.Write([]byte{RecordZero})
+	}
+	h.Write(sum[:])
+	var next [sha256.Size]byte
+	copy(next[:], h.Sum(nil))
+	return next
+}
@@ -0,0 +1,203 @@
+package lvbackup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperblock/lvdiff/lvbackup/vgcfg"
+)
+
+func TestPatchState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if st, err := loadPatchState(path); st != nil || err != nil {
+		t.Fatalf("missing state file: %+v, %v", st, err)
+	}
+	st := &patchState{Stream: "ab01", Volume: "vol", Target: "vol_lvpatch", Blocks: 7, Digest: "cd02"}
+	if err := st.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loadPatchState(path); err != nil || *got != *st {
+		t.Fatalf("%+v, %v", got, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left: %v", err)
+	}
+	os.WriteFile(path, []byte("Applied blocks: [1"), 0600)
+	if _, err := loadPatchState(path); err == nil {
+		t.Error("damaged state file loaded")
+	}
+}
+
+func TestChainDigest(t *testing.T) {
+	write := streamBlock{Offset: 4096, Length: 4, Data: []byte{0, 0, 0, 0}}
+	zero := streamBlock{Offset: 4096, Length: 4}
+	moved := streamBlock{Offset: 8192, Length: 4, Data: write.Data}
+	chain := func(blocks ...streamBlock) [sha256.Size]byte {
+		var d [sha256.Size]byte
+		for _, b := range blocks {
+			d = chainDigest(d, b, blockDigest(b))
+		}
+		return d
+	}
+
+	if blockDigest(zero) != ([sha256.Size]byte{}) || blockDigest(write) != sha256.Sum256(write.Data) {
+		t.Fatal("block digests")
+	}
+	if chain(write, moved) != chain(write, moved) {
+		t.Fatal("digest is not deterministic")
+	}
+	differ := [][2][]streamBlock{
+		{{write}, {zero}},
+		{{write}, {moved}},
+		{{write, moved}, {moved, write}},
+		{{write}, {write, zero}},
+	}
+	for i, d := range differ {
+		if chain(d[0]...) == chain(d[1]...) {
+			t.Errorf("chains %d have the same digest", i)
+		}
+	}
+}
+
+const resumeConfig = `vg0 {
+id = "vg-id"
+extent_size = 8192
+logical_volumes {
+pool0 {
+id = "pool-id"
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 100
+type = "thin-pool"
+metadata = "pool0_tmeta"
+pool = "pool0_tdata"
+transaction_id = 3
+chunk_size = 128
+}
+}
+vol_lvpatch {
+id = "temp-id"
+tags = ["lvpatch_incomplete"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 4
+type = "thin"
+thin_pool = "pool0"
+transaction_id = 2
+device_id = 2
+}
+}
+vol {
+id = "vol-id"
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 4
+type = "thin"
+thin_pool = "pool0"
+transaction_id = 1
+device_id = 1
+}
+}
+}
+}
+`
+
+func TestPrepareResume(t *testing.T) {
+	root, err := vgcfg.Parse(strings.NewReader(resumeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		target     string
+		streamType uint8
+		blockSize  uint32
+		err        string
+		tempLv     string
+		replaceLv  string
+	}{
+		{"vol_lvpatch", StreamTypeDelta, 65536, "", "vol_lvpatch", ""},
+		{"vol_lvpatch", StreamTypeFull, 65536, "", "vol_lvpatch", "vol"},
+		{"vol_lvpatch", StreamTypeDelta, 4096, "block size does not match", "", ""},
+		{"vol", StreamTypeDelta, 65536, "thin lv vol of the state file is not tagged lvpatch_incomplete", "", ""},
+		{"gone_lvpatch", StreamTypeDelta, 65536, "thin lv gone_lvpatch of the state file does not exist", "", ""},
+	}
+	for _, c := range cases {
+		sr := &streamRecver{
+			vgname: "vg0",
+			header: streamHeader{Name: "vol", StreamType: c.streamType, BlockSize: c.blockSize},
+			state:  &patchState{Volume: "vol", Target: c.target, Blocks: 3},
+		}
+		err := sr.prepareResume(root)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("target %s: got %v, want %q", c.target, err, c.err)
+			}
+			continue
+		}
+		if err != nil || sr.lvname != c.target || sr.tempLv != c.tempLv || sr.replaceLv != c.replaceLv {
+			t.Errorf("target %s, type %d: %v, lv %s, temporary %s, replacing %q", c.target, c.streamType, err, sr.lvname, sr.tempLv, sr.replaceLv)
+		}
+	}
+}
+
+func TestResumeImage(t *testing.T) {
+	stream, img := imageStream(t)
+	cut := stream[:len(stream)/2]
+	dir := t.TempDir()
+	target, state := filepath.Join(dir, "out"), filepath.Join(dir, "state")
+
+	// the temporary image is kept and the progress checkpointed
+	if err := patchImage(cut, target, state); err == nil {
+		t.Fatal("stream cut short patched")
+	}
+	st, err := loadPatchState(state)
+	if err != nil || st == nil || st.Target != tempLvName(target) || st.Blocks == 0 || st.Blocks >= 64 {
+		t.Fatalf("state after the interrupted run: %+v, %v", st, err)
+	}
+	if fileExists(target) || !fileExists(tempLvName(target)) {
+		t.Fatal("temporary image not kept")
+	}
+
+	// a state file of another stream or volume, or of other blocks, is
+	// refused
+	mismatched := []struct {
+		name string
+		st   patchState
+		err  string
+	}{
+		{"other volume", patchState{Stream: st.Stream, Volume: "other", Target: st.Target, Blocks: st.Blocks, Digest: st.Digest}, "belongs to another stream or volume"},
+		{"other stream", patchState{Stream: strings.Repeat("0", 64), Volume: st.Volume, Target: st.Target, Blocks: st.Blocks, Digest: st.Digest}, "belongs to another stream or volume"},
+		{"other digest", patchState{Stream: st.Stream, Volume: st.Volume, Target: st.Target, Blocks: st.Blocks, Digest: strings.Repeat("0", 64)}, "stream does not match the blocks applied by the earlier run"},
+		{"other blocks", patchState{Stream: st.Stream, Volume: st.Volume, Target: st.Target, Blocks: st.Blocks - 1, Digest: st.Digest}, "stream does not match the blocks applied by the earlier run"},
+	}
+	for _, m := range mismatched {
+		path := filepath.Join(dir, "state."+strings.Replace(m.name, " ", "_", -1))
+		if err := m.st.save(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := patchImage(stream, target, path); err == nil || !strings.Contains(err.Error(), m.err) {
+			t.Errorf("%s: got %v, want %q", m.name, err, m.err)
+		}
+		if fileExists(target) {
+			t.Fatalf("%s: image committed", m.name)
+		}
+	}
+
+	// the resumed run completes the image and removes the state file
+	if err := patchImage(stream, target, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(target); err != nil || !bytes.Equal(got, img) {
+		t.Fatalf("resumed image differs: %v", err)
+	}
+	if fileExists(state) || fileExists(tempLvName(target)) {
+		t.Error("state file or temporary image left")
+	}
+}
@@ -1,7 +1,9 @@
 package lvbackup
 
 import (
-	"crypto/md5"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
@@ -18,32 +20,134 @@ import (
 	"github.com/ncw/directio"
 )
 
+const (
+	DefaultMaxExtent = 4 << 20   // bytes of block data in one record
+	maxExtentLimit   = 256 << 20 // upper bound of SetMaxExtent
+)
+
 type streamSender struct {
 	vgname   string
 	lvname   string
 	srcname  string
 	detectLv int
+	scheme   int
+	compress uint8
+
+	comp blockCompressor
+
+	key    *StreamKey
+	cipher *recordCipher
+
+	signKey ed25519.PrivateKey
+	sigW    io.Writer // detached signatures, nil to embed them
+	headBuf []byte    // header record payload, covered by signatures
 
-	header streamHeader
-	blocks []thindelta.DeltaEntry
+	header    streamHeader
+	delta     *thindelta.DeltaBlocks // ranges of the volume to send
+	maxExtent int64
+	readDepth int // runs of chunks read ahead
+	engine    thindelta.Engine
 
-	w io.Writer
-	h hash.Hash
+	imageFile string // raw image to send instead of a thin lv
+	baseImage string // base image of a delta stream of imageFile
+	chunkSize int64  // block size of an image stream
+
+	w  io.Writer
+	h  hash.Hash    // SHA-256 of everything written to w
+	cw *countWriter // stream offset of the next record
+
+	records uint64 // records following the header written so far
+	index   []IndexEntry
+
+	written      int64 // write and zero records in the stream
+	writtenBytes int64 // block data bytes in the stream
 }
 
 func NewStreamSender(vgname, lvname, srcname string, w io.Writer, lv int) (*streamSender, error) {
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(w, h)}
 	return &streamSender{
-		vgname:   vgname,
-		lvname:   lvname,
-		srcname:  srcname,
-		detectLv: lv,
-		w:        w,
-		h:        md5.New(),
+		vgname:    vgname,
+		lvname:    lvname,
+		srcname:   srcname,
+		detectLv:  lv,
+		scheme:    StreamSchemeV1,
+		maxExtent: DefaultMaxExtent,
+		readDepth: DefaultReadDepth,
+		w:         cw,
+		h:         h,
+		cw:        cw,
 	}, nil
 }
 
+// SetMaxExtent limits the bytes of block data sent in one record. It is
+// rounded down to whole chunks, at least one. Text streams always send one
+// chunk per record.
+func (s *streamSender) SetMaxExtent(size int64) error {
+	if size <= 0 || size > maxExtentLimit {
+		return fmt.Errorf("max extent size must be between 1 and %d bytes", maxExtentLimit)
+	}
+	s.maxExtent = size
+	return nil
+}
+
+// SetDeltaEngine selects how the mappings of the volumes are read from
+// the pool metadata, thindelta.EngineAuto by default.
+func (s *streamSender) SetDeltaEngine(e thindelta.Engine) {
+	s.engine = e
+}
+
+// SetScheme selects the stream format, StreamSchemeV1 (text) or
+// StreamSchemeV2 (binary records).
+func (s *streamSender) SetScheme(scheme int) error {
+	if scheme != StreamSchemeV1 && scheme != StreamSchemeV2 {
+		return fmt.Errorf("unsupported stream scheme %d", scheme)
+	}
+	s.scheme = scheme
+	return nil
+}
+
+// SetCompression selects the compression algorithm of block data. It is
+// only supported by StreamSchemeV2.
+func (s *streamSender) SetCompression(algo uint8) error {
+	comp, err := newBlockCompressor(algo)
+	if err != nil {
+		return err
+	}
+	s.compress = algo
+	s.comp = comp
+	return nil
+}
+
+// SetEncryption seals every record after the stream header with a key
+// derived from k. It is only supported by StreamSchemeV2.
+func (s *streamSender) SetEncryption(k *StreamKey) {
+	s.key = k
+}
+
+// SetSigning signs the header and the trailer of the stream with key. The
+// signatures are written to w if it is not nil, otherwise embedded in the
+// stream. It is only supported by StreamSchemeV2.
+func (s *streamSender) SetSigning(key ed25519.PrivateKey, w io.Writer) {
+	s.signKey = key
+	s.sigW = w
+}
+
 func (s *streamSender) prepare() error {
 
+	if s.compress != CompressNone && s.scheme != StreamSchemeV2 {
+		return errors.New("compression requires binary stream format")
+	}
+	if s.key != nil && s.scheme != StreamSchemeV2 {
+		return errors.New("encryption requires binary stream format")
+	}
+	if s.signKey != nil && s.scheme != StreamSchemeV2 {
+		return errors.New("signing requires binary stream format")
+	}
+	if len(s.imageFile) > 0 {
+		return s.prepareImage()
+	}
+
 	root, err := vgcfg.Dump(s.vgname)
 	if err != nil {
 		return err
@@ -78,23 +182,35 @@ func (s *streamSender) prepare() error {
 	// dump block mapping
 	tpoolDev := lvmutil.TPoolDevicePath(s.vgname, pool.Name)
 	tmetaDev := lvmutil.LvDevicePath(s.vgname, pool.MetaName)
-	deltaBlocks, count, err := thindelta.Delta(tpoolDev, tmetaDev, lv.DeviceId, srclv.DeviceId)
-	if err != nil {
-		fmt.Printf("thindump.Delta: %v\n", err)
-		return err
+	var deltaBlocks *thindelta.DeltaBlocks
+	if srclv != nil {
+		deltaBlocks, err = s.engine.Delta(tpoolDev, tmetaDev, lv.DeviceId, srclv.DeviceId)
+		if err != nil {
+			return fmt.Errorf("thindelta.Delta: %v", err)
+		}
+	} else {
+		// full stream: all mapped chunks of the volume
+		dev, err := s.engine.Dump(tpoolDev, tmetaDev, lv.DeviceId)
+		if err != nil {
+			return fmt.Errorf("thindelta.Dump: %v", err)
+		}
+		deltaBlocks = dev.DeltaBlocks()
 	}
 
-	s.blocks = deltaBlocks
-	//	s.header.SchemeVersion = StreamSchemeV1
-	//	s.header.StreamType = StreamTypeFull
+	s.delta = deltaBlocks
+	s.header.SchemeVersion = uint8(s.scheme)
+	s.header.StreamType = StreamTypeFull
+	s.header.Compression = s.compress
 	s.header.Name = lv.Name
 	s.header.VolumeSize = uint64(lv.ExtentCount) * uint64(root.ExtentSize())
 	s.header.BlockSize = uint32(pool.ChunkSize)
 	s.header.VolumeUUID = lv.UUID
-	s.header.BlockCount = uint64(count)
-	s.header.DetectLevel = s.detectLv
+	s.header.BlockCount = uint64(deltaBlocks.ChangedBlocks())
 	if srclv != nil {
+		s.header.StreamType = StreamTypeDelta
+		s.header.DetectLevel = s.detectLv
 		s.header.DeltaSourceUUID = srclv.UUID
+		s.header.BaseSize = uint64(srclv.ExtentCount) * uint64(root.ExtentSize())
 	}
 
 	return nil
@@ -112,7 +228,8 @@ func (s *streamSender) Run(header []byte) error {
 		return err
 	}
 
-	if len(s.srcname) > 0 {
+	image := len(s.imageFile) > 0
+	if len(s.srcname) > 0 && !image {
 		// always activate original lv so that target lv can be activated later
 		if err := lvmutil.ActivateLv(s.vgname, s.srcname); err != nil {
 			return err
@@ -120,66 +237,95 @@ func (s *streamSender) Run(header []byte) error {
 		defer lvmutil.DeactivateLv(s.vgname, s.srcname)
 	}
 
-	if err := lvmutil.ActivateLv(s.vgname, s.lvname); err != nil {
-		return err
+	if !image {
+		if err := lvmutil.ActivateLv(s.vgname, s.lvname); err != nil {
+			return err
+		}
 	}
 	//	defer lvmutil.DeactivateLv(s.vgname, s.lvname)
 
 	dstDevpath := lvmutil.LvDevicePath(s.vgname, s.lvname)
-	srcDevpath := lvmutil.LvDevicePath(s.vgname, s.srcname)
 	blockSize := int64(s.header.BlockSize)
-	hashBlocks, err := thindelta.GenChecksum(srcDevpath, blockSize, s.blocks, s.detectLv)
-
-	//fmt.Fprintln(os.Stderr, checksum)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
-		return err
+	var hashBlocks []thindelta.BlockHash
+	if len(s.baseImage) > 0 && image {
+		f, err := os.Open(s.baseImage)
+		if err != nil {
+			return err
+		}
+		hashBlocks, err = thindelta.GenChecksumReader(imageReader{f}, blockSize, s.delta.Ranges(), s.detectLv)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+	} else if len(s.srcname) > 0 {
+		var err error
+		srcDevpath := lvmutil.LvDevicePath(s.vgname, s.srcname)
+		hashBlocks, err = thindelta.GenChecksum(srcDevpath, blockSize, s.delta.Ranges(), s.detectLv)
+
+		//fmt.Fprintln(os.Stderr, checksum)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, err.Error())
+			return err
+		}
 	}
 	if err := s.putBaseBlocks(hashBlocks); err != nil {
-		return nil
 		fmt.Fprintf(os.Stderr, err.Error())
 		return err
 	}
 
-	devFile, err := directio.OpenFile(dstDevpath, os.O_RDONLY, 0644)
+	var devFile *os.File
+	var err error
+	if image {
+		devFile, err = os.Open(s.imageFile)
+	} else {
+		devFile, err = directio.OpenFile(dstDevpath, os.O_RDONLY, 0644)
+	}
 	if err != nil {
 		return err
 	}
 	defer devFile.Close()
 
-	buf := directio.AlignedBlock(int(s.header.BlockSize))
+	if err := s.sendExtents(devFile, blockSize); err != nil {
+		return err
+	}
+	if err := s.putEnd(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "SHA256: %x\n", s.h.Sum(nil))
+	return nil
+}
 
-	for _, e := range s.blocks {
-		if e.OpType == thindelta.DeltaOpIgnore {
-			continue
-		}
-		if e.OpType == thindelta.DeltaOpDelete {
-			for i := 0; i < len(buf); i++ {
-				buf[i] = 0
-			} // clear chunk data
-		} else {
-			if _, err := devFile.Seek(e.OriginBlock*blockSize, os.SEEK_SET); err != nil {
+// func (s *streamSender) putHeader(header *streamHeader) error {
+func (s *streamSender) putHeader(header []byte) error {
+
+	if s.scheme == StreamSchemeV2 {
+		s.header.Meta = header
+		if s.key != nil {
+			e, err := newStreamEncryption(s.key)
+			if err != nil {
 				return err
 			}
-
-			if _, err := io.ReadFull(devFile, buf); err != nil {
+			s.header.Encryption = *e
+		}
+		headBuf, err := s.header.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if s.key != nil {
+			if s.cipher, err = newRecordCipher(&s.header.Encryption, s.key, headBuf); err != nil {
 				return err
 			}
 		}
-		//		if err := s.putBlock(e.OriginBlock, blockSize, buf); err != nil {
-		if err := s.putBlock(e.OriginBlock, blockSize, buf); err != nil {
+		if _, err := io.WriteString(s.w, C_HEAD_V2); err != nil {
 			return err
 		}
+		if err := writeRecord(s.w, RecordHeader, 0, headBuf); err != nil {
+			return err
+		}
+		s.headBuf = headBuf
+		return s.putSignature(SigHeader, nil)
 	}
-	SHA1Code := fmt.Sprintf("%x\n", s.h.Sum(nil))
-	// stdErr := os.Stderr
-	// stdErr.Write([]byte(SHA1Code))
-	fmt.Fprint(os.Stderr, "SHA1: "+SHA1Code)
-	return nil
-}
-
-//func (s *streamSender) putHeader(header *streamHeader) error {
-func (s *streamSender) putHeader(header []byte) error {
 
 	headBuf, err := yaml.Marshal(s.header)
 	//customHead, err := yaml.Marshal(header)
@@ -194,9 +340,67 @@ func (s *streamSender) putHeader(header []byte) error {
 	return nil
 }
 
+// putExtent sends the chunks in buf starting at chunk index. Binary
+// streams send runs of chunks reading as zeros as zero records and the
+// other runs as one write record each.
+func (s *streamSender) putExtent(index int64, blockSize int64, buf []byte) error {
+	for len(buf) > 0 {
+		if s.scheme != StreamSchemeV2 {
+			if err := s.putBlock(index, blockSize, buf[:blockSize]); err != nil {
+				return err
+			}
+			index++
+			buf = buf[blockSize:]
+			continue
+		}
+
+		zero := isZeroBlock(buf[:blockSize])
+		n := blockSize
+		for n < int64(len(buf)) && isZeroBlock(buf[n:n+blockSize]) == zero {
+			n += blockSize
+		}
+		if zero {
+			if err := s.putZero(index*blockSize, n); err != nil {
+				return err
+			}
+		} else if err := s.putBlock(index, blockSize, buf[:n]); err != nil {
+			return err
+		}
+		index += n / blockSize
+		buf = buf[n:]
+	}
+	return nil
+}
+
 func (s *streamSender) putBlock(index int64, blockSize int64, buf []byte) error {
 
-	subHead := []byte(fmt.Sprintf("W %X %X\n", index*(blockSize>>9), blockSize>>9))
+	if s.scheme == StreamSchemeV2 {
+		var head [writeHeadLength + 4]byte
+		binary.BigEndian.PutUint64(head[0:], uint64(index*blockSize))
+		binary.BigEndian.PutUint32(head[8:], blockChecksum(buf))
+
+		s.addIndex(RecordWrite, index*blockSize, int64(len(buf)))
+		var data []byte
+		if s.comp != nil {
+			var err error
+			if data, err = s.comp.compress(buf); err != nil {
+				return err
+			}
+		}
+		if data != nil {
+			binary.BigEndian.PutUint32(head[writeHeadLength:], uint32(len(buf)))
+			if err := s.putRecord(RecordWrite, FlagCompressed, head[:], data); err != nil {
+				return err
+			}
+		} else if err := s.putRecord(RecordWrite, 0, head[:writeHeadLength], buf); err != nil {
+			return err
+		}
+		s.written++
+		s.writtenBytes += int64(len(buf))
+		return nil
+	}
+
+	subHead := []byte(fmt.Sprintf("W %X %X\n", index*(blockSize>>9), len(buf)>>9))
 	if _, err := s.w.Write(subHead); err != nil {
 		return err
 	}
@@ -206,12 +410,40 @@ func (s *streamSender) putBlock(index int64, blockSize int64, buf []byte) error
 	}
 	//f.Write([]byte{0x0a})
 	s.w.Write([]byte{0x0a})
-	s.h.Write(buf)
+	s.written++
+	s.writtenBytes += int64(len(buf))
 	return nil
 }
 
+// putZero tells the receiver that the range reads as zeros, so it can be
+// discarded instead of written. Only for binary stream.
+func (s *streamSender) putZero(offset, length int64) error {
+	var payload [zeroRecordLength]byte
+	binary.BigEndian.PutUint64(payload[0:], uint64(offset))
+	binary.BigEndian.PutUint64(payload[8:], uint64(length))
+	s.addIndex(RecordZero, offset, length)
+	if err := s.putRecord(RecordZero, 0, payload[:]); err != nil {
+		return err
+	}
+	s.written++
+	return nil
+}
+
+func isZeroBlock(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *streamSender) putBaseBlocks(blocks []thindelta.BlockHash) error {
 
+	if s.scheme == StreamSchemeV2 {
+		return s.putRecord(RecordBaseHash, 0, encodeBaseBlocks(blocks))
+	}
+
 	for _, block := range blocks {
 		subHead := []byte(fmt.Sprintf("D %X %X %s %s\n", block.Offset, block.Length, block.HashType, block.Value))
 		if _, err := s.w.Write(subHead); err != nil {
@@ -224,3 +456,58 @@ func (s *streamSender) putBaseBlocks(blocks []thindelta.BlockHash) error {
 
 	return nil
 }
+
+// addIndex records the position of the record written next.
+func (s *streamSender) addIndex(typ uint8, offset, length int64) {
+	s.index = append(s.index, IndexEntry{Type: typ, Offset: offset, Length: length, Pos: s.cw.n, Seq: s.records})
+}
+
+func (s *streamSender) putEnd() error {
+	if s.scheme == StreamSchemeV2 {
+		footer := streamFooter{Offset: s.cw.n, Seq: s.records}
+		if err := s.putRecord(RecordIndex, 0, encodeIndex(s.index)); err != nil {
+			return err
+		}
+		footer.Length = uint32(s.cw.n - footer.Offset)
+
+		t := streamTrailer{
+			Blocks: uint64(s.written),
+			Bytes:  uint64(s.writtenBytes),
+		}
+		copy(t.Digest[:], s.h.Sum(nil))
+		trailer := t.marshal()
+		if err := s.putRecord(RecordTrailer, 0, trailer); err != nil {
+			return err
+		}
+		if err := s.putSignature(SigTrailer, trailer); err != nil {
+			return err
+		}
+		if err := s.putRecord(RecordEnd, 0); err != nil {
+			return err
+		}
+		_, err := s.w.Write(footer.marshal())
+		return err
+	}
+	return nil
+}
+
+// putRecord writes a record following the stream header, sealed if the
+// stream is encrypted.
+func (s *streamSender) putRecord(typ, flags uint8, payload ...[]byte) error {
+	s.records++
+	if s.cipher != nil {
+		return writeRecord(s.w, typ, flags, s.cipher.seal(typ, flags, payload...))
+	}
+	return writeRecord(s.w, typ, flags, payload...)
+}
+
+func (s *streamSender) putSignature(kind uint8, trailer []byte) error {
+	if s.signKey == nil {
+		return nil
+	}
+	sig := signStream(s.signKey, kind, s.headBuf, trailer)
+	if s.sigW != nil {
+		return writeRecord(s.sigW, RecordSignature, 0, sig.marshal())
+	}
+	return s.putRecord(RecordSignature, 0, sig.marshal())
+}
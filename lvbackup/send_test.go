@@ -0,0 +1,69 @@
+package lvbackup
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPutExtent(t *testing.T) {
+	chunk := func(b byte) []byte { return bytes.Repeat([]byte{b}, 4096) }
+	join := func(chunks ...[]byte) []byte { return bytes.Join(chunks, nil) }
+	zero := chunk(0)
+	extents := []struct {
+		index int64
+		buf   []byte
+	}{
+		{2, join(chunk(1), chunk(2), zero, zero, chunk(3))}, // adjacent data and zero chunks
+		{10, join(zero, zero)},                              // all zero
+		{13, chunk(4)},                                      // after a gap
+		{14, join(chunk(5), zero)},                          // adjacent to the extent before
+	}
+	want := map[int][]streamBlock{
+		StreamSchemeV2: {
+			{2 * 4096, 2 * 4096, join(chunk(1), chunk(2))},
+			{4 * 4096, 2 * 4096, nil},
+			{6 * 4096, 4096, chunk(3)},
+			{10 * 4096, 2 * 4096, nil},
+			{13 * 4096, 4096, chunk(4)},
+			{14 * 4096, 4096, chunk(5)},
+			{15 * 4096, 4096, nil},
+		},
+	}
+	// text streams have no zero records
+	for _, e := range extents {
+		for i := 0; i < len(e.buf); i += 4096 {
+			want[StreamSchemeV1] = append(want[StreamSchemeV1], streamBlock{e.index*4096 + int64(i), 4096, e.buf[i : i+4096]})
+		}
+	}
+
+	for _, scheme := range []int{StreamSchemeV1, StreamSchemeV2} {
+		var out bytes.Buffer
+		s, _ := NewStreamSender("vg", "lv", "", &out, 0)
+		if err := s.SetScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+		s.header = streamHeader{SchemeVersion: uint8(scheme), StreamType: StreamTypeDelta, Name: "lv", VolumeSize: 1 << 20, BlockSize: 4096, BlockCount: 10}
+		s.putHeader(nil)
+		s.putBaseBlocks(nil)
+		for _, e := range extents {
+			if err := s.putExtent(e.index, 4096, e.buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.putEnd(); err != nil {
+			t.Fatal(err)
+		}
+
+		blocks, err := readTestStream(out.Bytes(), nil, nil)
+		if err != nil {
+			t.Fatalf("scheme %d: %v", scheme, err)
+		}
+		if !reflect.DeepEqual(blocks, want[scheme]) {
+			for _, b := range blocks {
+				t.Logf("%d+%d, %d bytes", b.Offset, b.Length, len(b.Data))
+			}
+			t.Errorf("scheme %d: records do not match", scheme)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package lvbackup
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	SigHeader  = 1 // signs the header record, follows the header
+	SigTrailer = 2 // signs the header and the trailer record, follows the trailer
+
+	signatureLength = 1 + 8 + ed25519.SignatureSize
+)
+
+// streamSignature is the payload of a RecordSignature record. Detached
+// signatures are kept in a file of RecordSignature records.
+type streamSignature struct {
+	Kind  uint8
+	KeyID [8]byte
+	Sig   [ed25519.SignatureSize]byte
+}
+
+func (s *streamSignature) marshal() []byte {
+	b := make([]byte, 0, signatureLength)
+	b = append(b, s.Kind)
+	b = append(b, s.KeyID[:]...)
+	return append(b, s.Sig[:]...)
+}
+
+func (s *streamSignature) unmarshal(b []byte) error {
+	if len(b) != signatureLength {
+		return errors.New("length of signature record is wrong")
+	}
+	s.Kind = b[0]
+	copy(s.KeyID[:], b[1:9])
+	copy(s.Sig[:], b[9:])
+	if s.Kind != SigHeader && s.Kind != SigTrailer {
+		return fmt.Errorf("unknown signature kind %d", s.Kind)
+	}
+	return nil
+}
+
+func signingKeyID(pub ed25519.PublicKey) [8]byte {
+	var id [8]byte
+	sum := sha256.Sum256(pub)
+	copy(id[:], sum[:])
+	return id
+}
+
+// signedMessage returns what a signature of kind covers: the hash of the
+// header record payload and, for SigTrailer, the trailer record payload.
+func signedMessage(kind uint8, header, trailer []byte) []byte {
+	sum := sha256.Sum256(header)
+	msg := []byte(fmt.Sprintf("HYPERLAYER signature %d\x00", kind))
+	msg = append(msg, sum[:]...)
+	return append(msg, trailer...)
+}
+
+func signStream(priv ed25519.PrivateKey, kind uint8, header, trailer []byte) *streamSignature {
+	s := &streamSignature{Kind: kind, KeyID: signingKeyID(priv.Public().(ed25519.PublicKey))}
+	copy(s.Sig[:], ed25519.Sign(priv, signedMessage(kind, header, trailer)))
+	return s
+}
+
+// LoadSigningKey reads an Ed25519 private key in PKCS #8 PEM format, as
+// written by 'openssl genpkey -algorithm ed25519'.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return priv, nil
+}
+
+// LoadTrustedKeys reads Ed25519 public keys in PKIX PEM format. The file
+// may hold any number of keys.
+func LoadTrustedKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := []ed25519.PublicKey{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s holds a key which is not Ed25519", path)
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key in %s", path)
+	}
+	return keys, nil
+}
+
+// streamVerifier checks the signatures of a binary stream against trusted
+// keys. Signatures come from the stream itself or from a detached file.
+type streamVerifier struct {
+	keys     []ed25519.PublicKey
+	require  bool
+	detached map[uint8]*streamSignature
+}
+
+func (v *streamVerifier) requireSigned() bool {
+	return v != nil && v.require
+}
+
+func (v *streamVerifier) loadDetached(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	v.detached = map[uint8]*streamSignature{}
+	rr := recordReader{r: f}
+	for {
+		typ, _, payload, err := rr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if typ != RecordSignature {
+			return fmt.Errorf("unexpected record %q in signature file %s", typ, path)
+		}
+		sig := &streamSignature{}
+		if err := sig.unmarshal(payload); err != nil {
+			return err
+		}
+		v.detached[sig.Kind] = sig
+	}
+}
+
+// verify checks the signature of kind. sig is the signature found in the
+// stream, nil if there is none; a detached signature takes precedence. It
+// returns the verified signature, or nil if the stream is not signed and
+// unsigned streams are accepted. A nil verifier checks nothing.
+func (v *streamVerifier) verify(kind uint8, sig *streamSignature, header, trailer []byte) (*streamSignature, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if d, ok := v.detached[kind]; ok {
+		sig = d
+	}
+	if sig == nil {
+		if v.require {
+			return nil, errors.New("stream is not signed")
+		}
+		return nil, nil
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("stream is signed, but no trusted key is given")
+	}
+
+	for _, pub := range v.keys {
+		if signingKeyID(pub) != sig.KeyID {
+			continue
+		}
+		if !ed25519.Verify(pub, signedMessage(kind, header, trailer), sig.Sig[:]) {
+			return nil, fmt.Errorf("bad signature of key %x", sig.KeyID)
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("stream is signed by untrusted key %x", sig.KeyID)
+}
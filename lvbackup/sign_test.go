@@ -0,0 +1,133 @@
+package lvbackup
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testVerifier returns the verifier lvpatch sets up for the trusted keys,
+// --require-signature and --signature.
+func testVerifier(t *testing.T, keys []ed25519.PublicKey, require bool, sigs []byte) *streamVerifier {
+	sigFile := ""
+	if sigs != nil {
+		sigFile = filepath.Join(t.TempDir(), "stream.sig")
+		if err := os.WriteFile(sigFile, sigs, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sr := &streamRecver{}
+	if err := sr.SetVerification(keys, require, sigFile); err != nil {
+		t.Fatal(err)
+	}
+	return sr.verifier
+}
+
+func TestStreamSignatures(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	blocks := map[int64][]byte{5: bytes.Repeat([]byte{7}, 4096)}
+	signed := writeTestStream(t, func(s *streamSender) { s.SetSigning(priv, nil) }, blocks)
+	unsigned := writeTestStream(t, nil, blocks)
+	var sigs bytes.Buffer
+	detached := writeTestStream(t, func(s *streamSender) { s.SetSigning(priv, &sigs) }, blocks)
+	if !bytes.Equal(detached, unsigned) {
+		t.Fatal("detached signatures change the stream")
+	}
+	otherBlocks := map[int64][]byte{5: bytes.Repeat([]byte{8}, 4096)}
+	otherStream := writeTestStream(t, nil, otherBlocks)
+
+	// the trailer signature dropped from a signed stream
+	sigRecord := recordHeadLength + signatureLength
+	end := len(signed) - footerLength - recordHeadLength
+	stripped := append(append([]byte{}, signed[:end-sigRecord]...), signed[end:]...)
+
+	trusted := []ed25519.PublicKey{pub}
+	cases := []struct {
+		name     string
+		stream   []byte
+		verifier *streamVerifier
+		err      string
+	}{
+		{"embedded", signed, testVerifier(t, trusted, true, nil), ""},
+		{"embedded, not verified", signed, nil, ""},
+		{"embedded, untrusted key", signed, testVerifier(t, []ed25519.PublicKey{other}, false, nil), "header signature: stream is signed by untrusted key"},
+		{"embedded, no trusted key", signed, testVerifier(t, nil, false, nil), "header signature: stream is signed, but no trusted key is given"},
+		{"trailer signature dropped", stripped, testVerifier(t, trusted, false, nil), "trailer signature is missing"},
+		{"detached", detached, testVerifier(t, trusted, true, sigs.Bytes()), ""},
+		{"detached, file missing", detached, testVerifier(t, trusted, true, nil), "header signature: stream is not signed"},
+		{"detached, other stream", otherStream, testVerifier(t, trusted, true, sigs.Bytes()), "trailer signature: bad signature of key"},
+		{"unsigned", unsigned, testVerifier(t, trusted, false, nil), ""},
+		{"unsigned, signature required", unsigned, testVerifier(t, trusted, true, nil), "header signature: stream is not signed"},
+	}
+	for _, c := range cases {
+		_, err := readTestStream(c.stream, nil, c.verifier)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.HasPrefix(err.Error(), c.err)) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestTextStreamSignatureRequired(t *testing.T) {
+	var out bytes.Buffer
+	s, _ := NewStreamSender("vg", "lv", "", &out, 0)
+	s.header = streamHeader{Name: "lv", VolumeSize: 1 << 20, BlockSize: 4096, BlockCount: 1}
+	s.putHeader(nil)
+	s.putBaseBlocks(nil)
+	s.putBlock(5, 4096, bytes.Repeat([]byte{7}, 4096))
+	s.putEnd()
+	pub, _, _ := ed25519.GenerateKey(nil)
+
+	if _, err := readTestStream(out.Bytes(), nil, testVerifier(t, []ed25519.PublicKey{pub}, false, nil)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readTestStream(out.Bytes(), nil, testVerifier(t, []ed25519.PublicKey{pub}, true, nil))
+	if err == nil || !strings.Contains(err.Error(), "HYPERLAYER/1.0 streams can not be signed") {
+		t.Fatalf("unsigned text stream with a signature required: %v", err)
+	}
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	write := func(name, typ string, der ...[]byte) string {
+		var b bytes.Buffer
+		for _, d := range der {
+			pem.Encode(&b, &pem.Block{Type: typ, Bytes: d})
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	pub2DER, _ := x509.MarshalPKIXPublicKey(pub2)
+	privFile := write("key.pem", "PRIVATE KEY", privDER)
+	pubFile := write("trusted.pem", "PUBLIC KEY", pubDER, pub2DER)
+	empty := write("empty.pem", "")
+
+	if k, err := LoadSigningKey(privFile); err != nil || !k.Equal(priv) {
+		t.Errorf("signing key: %v", err)
+	}
+	keys, err := LoadTrustedKeys(pubFile)
+	if err != nil || len(keys) != 2 || !keys[0].Equal(pub) || !keys[1].Equal(pub2) {
+		t.Errorf("trusted keys: %d, %v", len(keys), err)
+	}
+	if _, err := LoadSigningKey(pubFile); err == nil {
+		t.Error("public key loaded as signing key")
+	}
+	if _, err := LoadSigningKey(empty); err == nil {
+		t.Error("signing key loaded from an empty file")
+	}
+	if _, err := LoadTrustedKeys(empty); err == nil {
+		t.Error("trusted keys loaded from an empty file")
+	}
+}
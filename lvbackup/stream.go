@@ -1,27 +1,34 @@
 package lvbackup
 
 import (
+	"bytes"
 	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 )
 
 const (
-	StreamSchemeV1 = 1
+	StreamSchemeV1 = 1 // HYPERLAYER/1.0, yaml header and text sub-headers
+	StreamSchemeV2 = 2 // HYPERLAYER/2.0, binary records
 
 	StreamTypeFull  = 1
 	StreamTypeDelta = 2
-
-	SchemeV1HeaderLength = 94 + md5.Size
 )
 
 const C_HEAD = "HYPERLAYER/1.0\n"
+const C_HEAD_V2 = "HYPERLAYER/2.0\n"
 
 type streamHeader struct {
-	//	SchemeVersion uint8  // scheme version
-	//StreamType    uint8  // type of the stream: full or delta
+	SchemeVersion uint8 `yaml:"-"`                     // scheme version
+	StreamType    uint8 `yaml:"Stream type,omitempty"` // type of the stream: full or delta, 0 is delta
+
 	Name       string `yaml:"Name"`
-	VolumeSize uint64 `yaml:"Volume size"`  // full size of logical volume
-	BlockSize  uint32 `yaml:"Chunk size"`   // block size of logical volume
-	BlockCount uint64 `yaml:"Delta blocks"` // how many blocks in the stream
+	VolumeSize uint64 `yaml:"Volume size"`         // full size of logical volume
+	BaseSize   uint64 `yaml:"Base size,omitempty"` // size of the backing volume, only for delta stream
+	BlockSize  uint32 `yaml:"Chunk size"`          // block size of logical volume
+	BlockCount uint64 `yaml:"Delta blocks"`        // how many chunks the stream changes
 	//VolumeUUID    [36]byte `yaml:"UUID"` // UUID of logical volume
 	VolumeUUID  string `yaml:"VolumeUUID"`
 	DetectLevel int    `yaml:"Detect level"`
@@ -30,60 +37,122 @@ type streamHeader struct {
 	//	DeltaSourceUUID [36]byte       // only for delta stream
 	DeltaSourceUUID string `yaml:"Backing volumeUUID"` // only for delta stream
 
-	//	CheckSum        [md5.Size]byte // MD5 hash of stream header except this field
-}
-
-// func (h *streamHeader) MarshalBinary() ([]byte, error) {
-// 	var b [SchemeV1HeaderLength]byte
-
-// 	buf := bytes.NewBuffer(b[:0])
-
-// 	buf.WriteByte(h.SchemeVersion)
-// 	buf.WriteByte(h.StreamType)
+	Compression uint8            `yaml:"Compression,omitempty"` // compression algorithm of block data, only for binary stream
+	Encryption  streamEncryption `yaml:"-"`                     // only for binary stream
 
-// 	binary.Write(buf, binary.BigEndian, h.VolumeSize)
-// 	binary.Write(buf, binary.BigEndian, h.BlockSize)
-// 	binary.Write(buf, binary.BigEndian, h.BlockCount)
-
-// 	buf.Write(h.VolumeUUID[:])
-// 	buf.Write(h.DeltaSourceUUID[:])
+	Meta []byte `yaml:"-"` // user supplied 'key: value' lines, only for binary stream
+}
 
-// 	hash := md5.Sum(buf.Bytes())
-// 	buf.Write(hash[:])
+func putString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
 
-// 	if buf.Len() != SchemeV1HeaderLength {
-// 		panic("why binary stream header length is wrong?")
-// 	}
+func getString(r *bytes.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
 
-// 	return b[:], nil
-// }
+// MarshalBinary encodes the header as the payload of a RecordHeader record.
+// The last md5.Size bytes are the MD5 hash of everything before them.
+func (h *streamHeader) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
 
-// func (h *streamHeader) UnmarshalBinary(b []byte) error {
-// 	if b[0] != StreamSchemeV1 {
-// 		return fmt.Errorf("invalid scheme version %d", b[0])
-// 	}
+	buf.WriteByte(h.SchemeVersion)
+	buf.WriteByte(h.StreamType)
 
-// 	if len(b) != SchemeV1HeaderLength {
-// 		return errors.New("length of stream header data is wrong")
-// 	}
+	binary.Write(buf, binary.BigEndian, h.VolumeSize)
+	binary.Write(buf, binary.BigEndian, h.BaseSize)
+	binary.Write(buf, binary.BigEndian, h.BlockSize)
+	binary.Write(buf, binary.BigEndian, h.BlockCount)
+	buf.WriteByte(uint8(h.DetectLevel))
+	buf.WriteByte(h.Compression)
+	h.Encryption.marshal(buf)
 
-// 	n := SchemeV1HeaderLength - md5.Size
-// 	sum := md5.Sum(b[:n])
-// 	if !bytes.Equal(sum[:], b[n:n+md5.Size]) {
-// 		return errors.New("stream header hash mismatch")
-// 	}
+	putString(buf, h.Name)
+	putString(buf, h.VolumeUUID)
+	putString(buf, h.DeltaSourceUUID)
 
-// 	buf := bytes.NewReader(b[:n])
-// 	h.SchemeVersion, _ = buf.ReadByte()
-// 	h.StreamType, _ = buf.ReadByte()
+	binary.Write(buf, binary.BigEndian, uint32(len(h.Meta)))
+	buf.Write(h.Meta)
 
-// 	binary.Read(buf, binary.BigEndian, &h.VolumeSize)
-// 	binary.Read(buf, binary.BigEndian, &h.BlockSize)
-// 	binary.Read(buf, binary.BigEndian, &h.BlockCount)
+	hash := md5.Sum(buf.Bytes())
+	buf.Write(hash[:])
 
-// 	buf.Read(h.VolumeUUID[:])
-// 	buf.Read(h.DeltaSourceUUID[:])
-// 	buf.Read(h.CheckSum[:])
+	return buf.Bytes(), nil
+}
 
-// 	return nil
-// }
+func (h *streamHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 2+md5.Size {
+		return errors.New("length of stream header data is wrong")
+	}
+
+	if b[0] != StreamSchemeV2 {
+		return fmt.Errorf("invalid scheme version %d", b[0])
+	}
+
+	n := len(b) - md5.Size
+	sum := md5.Sum(b[:n])
+	if !bytes.Equal(sum[:], b[n:]) {
+		return errors.New("stream header hash mismatch")
+	}
+
+	buf := bytes.NewReader(b[:n])
+	h.SchemeVersion, _ = buf.ReadByte()
+	h.StreamType, _ = buf.ReadByte()
+
+	if err := binary.Read(buf, binary.BigEndian, &h.VolumeSize); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &h.BaseSize); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &h.BlockSize); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &h.BlockCount); err != nil {
+		return err
+	}
+	level, err := buf.ReadByte()
+	if err != nil {
+		return err
+	}
+	h.DetectLevel = int(level)
+	if h.Compression, err = buf.ReadByte(); err != nil {
+		return err
+	}
+	if err := h.Encryption.unmarshal(buf); err != nil {
+		return err
+	}
+
+	if h.Name, err = getString(buf); err != nil {
+		return err
+	}
+	if h.VolumeUUID, err = getString(buf); err != nil {
+		return err
+	}
+	if h.DeltaSourceUUID, err = getString(buf); err != nil {
+		return err
+	}
+
+	var metaLen uint32
+	if err := binary.Read(buf, binary.BigEndian, &metaLen); err != nil {
+		return err
+	}
+	if int64(metaLen) != int64(buf.Len()) {
+		return errors.New("length of stream header data is wrong")
+	}
+	h.Meta = make([]byte, metaLen)
+	if _, err := io.ReadFull(buf, h.Meta); err != nil {
+		return err
+	}
+
+	return nil
+}
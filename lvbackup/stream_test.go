@@ -0,0 +1,97 @@
+package lvbackup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rehash replaces the MD5 hash at the end of a marshaled header, so damage
+// to the fields in front of it is not caught by the hash check.
+func rehash(b []byte) []byte {
+	n := len(b) - md5.Size
+	sum := md5.Sum(b[:n])
+	return append(append([]byte{}, b[:n]...), sum[:]...)
+}
+
+func TestHeaderMarshalBinary(t *testing.T) {
+	encrypted := streamEncryption{Cipher: CipherAES256GCM, KDF: KDFScrypt, N: scryptN, R: scryptR, P: scryptP}
+	copy(encrypted.KeyID[:], "keyid123")
+	copy(encrypted.KDFSalt[:], "kdf salt")
+	copy(encrypted.Salt[:], "record salt")
+
+	headers := []streamHeader{
+		{SchemeVersion: StreamSchemeV2, Meta: []byte{}},
+		{
+			SchemeVersion: StreamSchemeV2, StreamType: StreamTypeFull,
+			Name: "vol0", VolumeSize: 1 << 40, BlockSize: 64 << 10, BlockCount: 3,
+			VolumeUUID: "7c2f0e6c-0d1a-4d4e-9d53-3b8f0c2d1e9a", DetectLevel: 2,
+			Meta: []byte{},
+		},
+		{
+			SchemeVersion: StreamSchemeV2, StreamType: StreamTypeDelta,
+			Name: "vol1", VolumeSize: 8 << 30, BaseSize: 4 << 30, BlockSize: 4096, BlockCount: 1 << 33,
+			VolumeUUID: "u1", DeltaSourceUUID: "u0", DetectLevel: 3, Compression: CompressZstd,
+			Encryption: encrypted,
+			Meta:       []byte("owner: ops\nticket: 42\n"),
+		},
+		{
+			SchemeVersion: StreamSchemeV2, StreamType: StreamTypeDelta,
+			Name: strings.Repeat("n", 1000), BlockSize: 512,
+			Meta: bytes.Repeat([]byte{0}, 70000),
+		},
+	}
+	for i, h := range headers {
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("header %d: %v", i, err)
+		}
+		var got streamHeader
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("header %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, h) {
+			t.Errorf("header %d: got %+v, want %+v", i, got, h)
+		}
+	}
+}
+
+func TestHeaderUnmarshalBinaryRejects(t *testing.T) {
+	h := streamHeader{SchemeVersion: StreamSchemeV2, StreamType: StreamTypeDelta, Name: "vol", BlockSize: 4096, Meta: []byte("a: b\n")}
+	good, _ := h.MarshalBinary()
+	n := len(good) - md5.Size
+
+	scheme := append([]byte{}, good...)
+	scheme[0] = StreamSchemeV1
+	flipped := append([]byte{}, good...)
+	flipped[10] ^= 1
+	metaLen := append([]byte{}, good[:n]...)
+	metaLen[n-len(h.Meta)-1]++
+	cipher := append([]byte{}, good[:n]...)
+	cipher[2+8+8+4+8+1+1] = 7
+
+	cases := []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"empty", nil, "length of stream header data is wrong"},
+		{"too short", good[:md5.Size+1], "length of stream header data is wrong"},
+		{"scheme version", scheme, "invalid scheme version 1"},
+		{"hash mismatch", flipped, "stream header hash mismatch"},
+		{"truncated sizes", rehash(good[:12+md5.Size]), "unexpected EOF"},
+		{"truncated name", rehash(append(append([]byte{}, good[:2+8+8+4+8+1+1+1+2]...), make([]byte, md5.Size)...)), "EOF"},
+		{"meta length", rehash(append(metaLen, make([]byte, md5.Size)...)), "length of stream header data is wrong"},
+		{"trailing data", rehash(append(append([]byte{}, good[:n]...), make([]byte, 1+md5.Size)...)), "length of stream header data is wrong"},
+		{"unknown cipher", rehash(append(cipher, make([]byte, md5.Size)...)), "unknown cipher 7"},
+	}
+	for _, c := range cases {
+		var got streamHeader
+		err := got.UnmarshalBinary(c.b)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
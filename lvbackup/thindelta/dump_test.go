@@ -0,0 +1,85 @@
+package thindelta
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testdata/thin_dump.xml and testdata/thin_delta.xml are written by hand
+// in the formats of thin_dump and thin_delta -m, the latter being the
+// delta of --snap1 2 --snap2 1 of the former. They are not output of the
+// tools.
+
+func readThinDelta(t *testing.T) *DeltaBlocks {
+	f, err := os.Open(filepath.Join("testdata", "thin_delta.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := ReadDeltaBlocks(NewDeltaDecoder(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func decodeDump(t *testing.T, ids ...int64) ([]*Device, error) {
+	f, err := os.Open(filepath.Join("testdata", "thin_dump.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return DecodeDevices(f, ids...)
+}
+
+func extents(t *testing.T, it ExtentIterator) []DeltaExtent {
+	ret := []DeltaExtent{}
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, e)
+	}
+}
+
+func TestDumpDeltaMatchesThinDelta(t *testing.T) {
+	devs, err := decodeDump(t, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devs[0].DevId != 2 || devs[1].DevId != 1 {
+		t.Fatalf("devices %d, %d", devs[0].DevId, devs[1].DevId)
+	}
+	got, err := CompareDevices(devs[0], devs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readThinDelta(t)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dump delta %+v, thin_delta %+v", got, want)
+	}
+	ranges := []DeltaExtent{
+		{0, 2, DeltaOpIgnore}, {2, 1, DeltaOpUpdate}, {3, 1, DeltaOpDelete}, {5, 2, DeltaOpCreate},
+		{10, 1, DeltaOpDelete}, {20, 1, DeltaOpIgnore}, {21, 1, DeltaOpCreate},
+	}
+	if r := extents(t, got.Ranges()); !reflect.DeepEqual(r, ranges) {
+		t.Fatalf("ranges %+v", r)
+	}
+	changes := []DeltaExtent{{2, 1, DeltaOpUpdate}, {3, 1, DeltaOpDelete}, {5, 2, DeltaOpCreate}, {10, 1, DeltaOpDelete}, {21, 1, DeltaOpCreate}}
+	if c := extents(t, Changes(want.Ranges())); !reflect.DeepEqual(c, changes) {
+		t.Fatalf("changes %+v", c)
+	}
+}
+
+func TestDumpMissingDevice(t *testing.T) {
+	if _, err := decodeDump(t, 2, 3); err == nil {
+		t.Fatal("missing device 3 found")
+	}
+}
@@ -0,0 +1,109 @@
+package thindelta
+
+import (
+	"fmt"
+	"os"
+)
+
+// Engine selects how the mappings of thin devices are read.
+type Engine int
+
+const (
+	EngineAuto      Engine = iota // thin_delta, falling back to EngineDump, then EngineNative
+	EngineThinDelta               // thin_delta and thin_dump of thin-provisioning-tools
+	EngineNative                  // the metadata reader of this package
+	EngineDump                    // thin_dump only, compared by CompareDevices
+)
+
+var engineNames = map[Engine]string{
+	EngineAuto:      "auto",
+	EngineThinDelta: "thin_delta",
+	EngineNative:    "native",
+	EngineDump:      "dump",
+}
+
+func (e Engine) String() string {
+	if name, ok := engineNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Engine(%d)", int(e))
+}
+
+// ParseEngine parses the name of an engine.
+func ParseEngine(name string) (Engine, error) {
+	for e, n := range engineNames {
+		if n == name {
+			return e, nil
+		}
+	}
+	return EngineAuto, fmt.Errorf("unknown delta engine %q, want auto, thin_delta, dump or native", name)
+}
+
+// NativeDelta is Delta reading the metadata snapshot with Metadata.
+func NativeDelta(tpoolDev, tmetaDev string, layer_id, parent_id int64) (*DeltaBlocks, error) {
+	if err := reserveMetadataSnap(tpoolDev); err != nil {
+		return nil, err
+	}
+	defer releaseMetadataSnap(tpoolDev)
+
+	m, err := OpenMetadata(tmetaDev)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	return m.Delta(layer_id, parent_id)
+}
+
+// NativeDump is Dump reading the metadata snapshot with Metadata.
+func NativeDump(tpoolDev, tmetaDev string, dev_id int64) (*Device, error) {
+	if err := reserveMetadataSnap(tpoolDev); err != nil {
+		return nil, err
+	}
+	defer releaseMetadataSnap(tpoolDev)
+
+	m, err := OpenMetadata(tmetaDev)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	return m.Device(dev_id)
+}
+
+// Delta returns the delta of thin device layer_id to parent_id.
+func (e Engine) Delta(tpoolDev, tmetaDev string, layer_id, parent_id int64) (*DeltaBlocks, error) {
+	switch e {
+	case EngineThinDelta:
+		return Delta(tpoolDev, tmetaDev, layer_id, parent_id)
+	case EngineNative:
+		return NativeDelta(tpoolDev, tmetaDev, layer_id, parent_id)
+	case EngineDump:
+		return DumpDelta(tpoolDev, tmetaDev, layer_id, parent_id)
+	}
+	delta, err := Delta(tpoolDev, tmetaDev, layer_id, parent_id)
+	if err == nil {
+		return delta, nil
+	}
+	fmt.Fprintf(os.Stderr, "thin_delta failed (%v), comparing the devices dumped by thin_dump.\n", err)
+	delta, err = DumpDelta(tpoolDev, tmetaDev, layer_id, parent_id)
+	if err == nil {
+		return delta, nil
+	}
+	fmt.Fprintf(os.Stderr, "thin_dump failed (%v), reading the pool metadata natively.\n", err)
+	return NativeDelta(tpoolDev, tmetaDev, layer_id, parent_id)
+}
+
+// Dump returns the mappings of thin device dev_id.
+func (e Engine) Dump(tpoolDev, tmetaDev string, dev_id int64) (*Device, error) {
+	switch e {
+	case EngineThinDelta, EngineDump:
+		return Dump(tpoolDev, tmetaDev, dev_id)
+	case EngineNative:
+		return NativeDump(tpoolDev, tmetaDev, dev_id)
+	}
+	dev, err := Dump(tpoolDev, tmetaDev, dev_id)
+	if err == nil {
+		return dev, nil
+	}
+	fmt.Fprintf(os.Stderr, "thin_dump failed (%v), reading the pool metadata natively.\n", err)
+	return NativeDump(tpoolDev, tmetaDev, dev_id)
+}
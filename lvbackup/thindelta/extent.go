@@ -0,0 +1,197 @@
+package thindelta
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ExtentIterator returns ranges of chunks in ascending order of
+// OriginBegin. Next returns io.EOF after the last one.
+type ExtentIterator interface {
+	Next() (DeltaExtent, error)
+}
+
+var deltaOps = map[string]DeltaOpType{
+	"left_only":  DeltaOpCreate,
+	"right_only": DeltaOpDelete,
+	"different":  DeltaOpUpdate,
+	"same":       DeltaOpIgnore,
+}
+
+// DeltaDecoder decodes the output of thin_delta one range at a time,
+// without holding the document in memory.
+type DeltaDecoder struct {
+	d   *xml.Decoder
+	end int64 // end of the last range
+}
+
+func NewDeltaDecoder(r io.Reader) *DeltaDecoder {
+	return &DeltaDecoder{d: xml.NewDecoder(r)}
+}
+
+// Next returns the next range of the diff, whatever device element it is
+// nested in.
+func (dd *DeltaDecoder) Next() (DeltaExtent, error) {
+	for {
+		tok, err := dd.d.Token()
+		if err != nil {
+			return DeltaExtent{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		op, ok := deltaOps[start.Name.Local]
+		if !ok {
+			continue
+		}
+		e := DeltaExtent{OpType: op, OriginBegin: -1, Length: -1}
+		for _, attr := range start.Attr {
+			v, err := strconv.ParseInt(attr.Value, 10, 64)
+			switch attr.Name.Local {
+			case "begin":
+				e.OriginBegin = v
+			case "length":
+				e.Length = v
+			default:
+				continue
+			}
+			if err != nil {
+				return DeltaExtent{}, fmt.Errorf("thin_delta: bad %s of <%s>: %v", attr.Name.Local, start.Name.Local, err)
+			}
+		}
+		if e.OriginBegin < 0 || e.Length <= 0 {
+			return DeltaExtent{}, fmt.Errorf("thin_delta: <%s> without valid begin and length", start.Name.Local)
+		}
+		if e.OriginBegin < dd.end {
+			return DeltaExtent{}, fmt.Errorf("thin_delta: <%s> at block %d out of order", start.Name.Local, e.OriginBegin)
+		}
+		dd.end = e.OriginBegin + e.Length
+		return e, nil
+	}
+}
+
+// ReadDeltaBlocks reads all ranges of it.
+func ReadDeltaBlocks(it ExtentIterator) (*DeltaBlocks, error) {
+	d := &DeltaBlocks{}
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			return d, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.AddRange(e.OpType, e.OriginBegin, e.Length)
+	}
+}
+
+// rangeIter merges the mappings of a DeltaBlocks, each sorted, by origin.
+type rangeIter struct {
+	d          *DeltaBlocks
+	l, r, x, s int // next left_only, right_only, different and same
+}
+
+// Ranges returns all ranges of d, same ones included, by origin.
+func (d *DeltaBlocks) Ranges() ExtentIterator {
+	return &rangeIter{d: d}
+}
+
+func (it *rangeIter) Next() (DeltaExtent, error) {
+	e := DeltaExtent{OriginBegin: -1}
+	var next *int
+	take := func(i *int, begin, length int64, op DeltaOpType) {
+		if next == nil || begin < e.OriginBegin {
+			e = DeltaExtent{OriginBegin: begin, Length: length, OpType: op}
+			next = i
+		}
+	}
+	d := it.d
+	if it.l < len(d.LeftOnlyMappings) {
+		m := d.LeftOnlyMappings[it.l]
+		take(&it.l, m.Begin, m.Length, DeltaOpCreate)
+	}
+	if it.r < len(d.RightOnlyMappings) {
+		m := d.RightOnlyMappings[it.r]
+		take(&it.r, m.Begin, m.Length, DeltaOpDelete)
+	}
+	if it.x < len(d.DifferentMappings) {
+		m := d.DifferentMappings[it.x]
+		take(&it.x, m.Begin, m.Length, DeltaOpUpdate)
+	}
+	if it.s < len(d.SameMappings) {
+		m := d.SameMappings[it.s]
+		take(&it.s, m.Begin, m.Length, DeltaOpIgnore)
+	}
+	if next == nil {
+		return DeltaExtent{}, io.EOF
+	}
+	*next++
+	return e, nil
+}
+
+// changeIter drops the same ranges of another iterator and merges
+// adjacent changed ones, see Changes.
+type changeIter struct {
+	it      ExtentIterator
+	pending DeltaExtent // Length 0 if none
+	err     error
+}
+
+// Changes returns the changed ranges of it. Adjacent ranges are merged if
+// both are written (left_only or different, merged into DeltaOpUpdate) or
+// both are deleted (right_only).
+func Changes(it ExtentIterator) ExtentIterator {
+	return &changeIter{it: it}
+}
+
+func (c *changeIter) Next() (DeltaExtent, error) {
+	for c.err == nil {
+		var e DeltaExtent
+		e, c.err = c.it.Next()
+		if c.err != nil {
+			break
+		}
+		if e.OpType == DeltaOpIgnore {
+			continue
+		}
+		last := &c.pending
+		if last.Length == 0 {
+			*last = e
+			continue
+		}
+		if last.OriginBegin+last.Length == e.OriginBegin && (last.OpType == DeltaOpDelete) == (e.OpType == DeltaOpDelete) {
+			if last.OpType != e.OpType {
+				last.OpType = DeltaOpUpdate
+			}
+			last.Length += e.Length
+			continue
+		}
+		ret := *last
+		*last = e
+		return ret, nil
+	}
+	if c.err == io.EOF && c.pending.Length > 0 {
+		ret := c.pending
+		c.pending = DeltaExtent{}
+		return ret, nil
+	}
+	return DeltaExtent{}, c.err
+}
+
+// ChangedBlocks returns the number of chunks which are not the same.
+func (d *DeltaBlocks) ChangedBlocks() int64 {
+	n := int64(0)
+	for _, m := range d.LeftOnlyMappings {
+		n += m.Length
+	}
+	for _, m := range d.RightOnlyMappings {
+		n += m.Length
+	}
+	for _, m := range d.DifferentMappings {
+		n += m.Length
+	}
+	return n
+}
@@ -27,11 +27,11 @@ func (a singleMappingsByOrigin) Len() int           { return len(a) }
 func (a singleMappingsByOrigin) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a singleMappingsByOrigin) Less(i, j int) bool { return a[i].OriginBlock < a[j].OriginBlock }
 
-type entryByOrigin []DeltaEntry
+type leftOnlyByBegin []LeftOnlyMapping
 
-func (a entryByOrigin) Len() int           { return len(a) }
-func (a entryByOrigin) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a entryByOrigin) Less(i, j int) bool { return a[i].OriginBlock < a[j].OriginBlock }
+func (a leftOnlyByBegin) Len() int           { return len(a) }
+func (a leftOnlyByBegin) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a leftOnlyByBegin) Less(i, j int) bool { return a[i].Begin < a[j].Begin }
 
 type Device struct {
 	XMLName      xml.Name `xml:"device"`
@@ -101,6 +101,59 @@ func (d *Device) ExpandRangeMappings() error {
 	return nil
 }
 
+// DeltaBlocks returns the mappings of the device as a delta against an
+// empty device, every mapped chunk being left_only.
+func (d *Device) DeltaBlocks() *DeltaBlocks {
+	delta := &DeltaBlocks{}
+	for _, m := range d.SingleMappings {
+		delta.LeftOnlyMappings = append(delta.LeftOnlyMappings, LeftOnlyMapping{Begin: m.OriginBlock, Length: 1})
+	}
+	for _, m := range d.RangeMapping {
+		delta.LeftOnlyMappings = append(delta.LeftOnlyMappings, LeftOnlyMapping{Begin: m.OriginBegin, Length: m.Length})
+	}
+	sort.Sort(leftOnlyByBegin(delta.LeftOnlyMappings))
+	return delta
+}
+
+// Add adds a chunk to the mappings of op, DeltaOpCreate for left_only,
+// DeltaOpDelete for right_only, DeltaOpUpdate for different and
+// DeltaOpIgnore for same.
+func (d *DeltaBlocks) Add(op DeltaOpType, block int64) {
+	d.AddRange(op, block, 1)
+}
+
+// AddRange adds length chunks from begin to the mappings of op. Ranges
+// must be added in ascending order for Ranges to return them in order;
+// a range adjacent to the last one of op is merged into it.
+func (d *DeltaBlocks) AddRange(op DeltaOpType, begin, length int64) {
+	switch op {
+	case DeltaOpCreate:
+		if n := len(d.LeftOnlyMappings); n > 0 && d.LeftOnlyMappings[n-1].Begin+d.LeftOnlyMappings[n-1].Length == begin {
+			d.LeftOnlyMappings[n-1].Length += length
+			return
+		}
+		d.LeftOnlyMappings = append(d.LeftOnlyMappings, LeftOnlyMapping{Begin: begin, Length: length})
+	case DeltaOpDelete:
+		if n := len(d.RightOnlyMappings); n > 0 && d.RightOnlyMappings[n-1].Begin+d.RightOnlyMappings[n-1].Length == begin {
+			d.RightOnlyMappings[n-1].Length += length
+			return
+		}
+		d.RightOnlyMappings = append(d.RightOnlyMappings, RightOnlyMapping{Begin: begin, Length: length})
+	case DeltaOpUpdate:
+		if n := len(d.DifferentMappings); n > 0 && d.DifferentMappings[n-1].Begin+d.DifferentMappings[n-1].Length == begin {
+			d.DifferentMappings[n-1].Length += length
+			return
+		}
+		d.DifferentMappings = append(d.DifferentMappings, DifferentMapping{Begin: begin, Length: length})
+	case DeltaOpIgnore:
+		if n := len(d.SameMappings); n > 0 && d.SameMappings[n-1].Begin+d.SameMappings[n-1].Length == begin {
+			d.SameMappings[n-1].Length += length
+			return
+		}
+		d.SameMappings = append(d.SameMappings, SameMapping{Begin: begin, Length: length})
+	}
+}
+
 type SuperBlock struct {
 	XMLName          xml.Name  `xml:"superblock"`
 	Time             int64     `xml:"time,attr"`
@@ -144,6 +197,13 @@ type DeltaEntry struct {
 	OpType      DeltaOpType `xml:"op,attr"`
 }
 
+// DeltaExtent is a run of contiguous chunks of one op.
+type DeltaExtent struct {
+	OriginBegin int64
+	Length      int64
+	OpType      DeltaOpType
+}
+
 type DeltaEntriesByDataBlock []DeltaEntry
 
 func (a DeltaEntriesByDataBlock) Len() int           { return len(a) }
@@ -0,0 +1,445 @@
+package thindelta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/ncw/directio"
+)
+
+// On-disk format of dm-thin pool metadata, as written by the kernel
+// (drivers/md/dm-thin-metadata.c and persistent-data/). All integers are
+// little endian, all metadata blocks are 4096 bytes.
+const (
+	MetadataBlockSize = 4096
+
+	superblockMagic   = 27022010
+	superblockCsumXor = 160774
+	btreeCsumXor      = 121107
+
+	nodeHeaderSize = 32
+	internalNode   = 1
+	leafNode       = 2
+	maxBtreeDepth  = 16 // far deeper than any tree of 64 bit keys gets
+
+	mappingValueSize = 8  // data block << 24 | time
+	detailsValueSize = 24 // mapped blocks, transaction, creation and snapshot time
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// metadataChecksum is dm_bm_checksum of the kernel: crc32c without the
+// final inversion of the whole block following the checksum field.
+func metadataChecksum(block []byte, xor uint32) uint32 {
+	return ^crc32.Checksum(block[4:], crc32c) ^ xor
+}
+
+type superblock struct {
+	time              uint32
+	transactionId     uint64
+	heldRoot          uint64 // block of the metadata snapshot, 0 if none
+	dataMappingRoot   uint64
+	deviceDetailsRoot uint64
+	dataBlockSize     uint32 // sectors
+	metadataBlocks    uint64 // from the metadata space map root, 0 in a snapshot
+	dataBlocks        uint64 // from the data space map root, 0 in a snapshot
+}
+
+// Metadata reads the reserved metadata snapshot of a thin pool, without
+// thin-provisioning-tools.
+type Metadata struct {
+	r  io.ReaderAt
+	f  *os.File   // nil unless opened by OpenMetadata
+	sb superblock // of the snapshot
+}
+
+// OpenMetadata opens the metadata device of a thin pool for direct reads.
+// A metadata snapshot must have been reserved, the live metadata changes
+// under our feet.
+func OpenMetadata(tmetaDev string) (*Metadata, error) {
+	f, err := directio.OpenFile(tmetaDev, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMetadata(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	m.f = f
+	return m, nil
+}
+
+// Close closes the metadata device opened by OpenMetadata.
+func (m *Metadata) Close() error {
+	if m.f == nil {
+		return nil
+	}
+	return m.f.Close()
+}
+
+// NewMetadata reads the superblock of the metadata in r and the superblock
+// of its reserved snapshot. r must accept aligned reads of whole blocks if
+// it is opened for direct I/O.
+func NewMetadata(r io.ReaderAt) (*Metadata, error) {
+	m := &Metadata{r: r}
+	live, err := m.readSuperblock(0)
+	if err != nil {
+		return nil, err
+	}
+	if live.heldRoot == 0 {
+		return nil, errors.New("thin pool metadata has no reserved metadata snapshot")
+	}
+	// the space map roots of the snapshot are wiped, bounds are checked
+	// against those of the live metadata
+	m.sb.metadataBlocks = live.metadataBlocks
+	snap, err := m.readSuperblock(live.heldRoot)
+	if err != nil {
+		return nil, fmt.Errorf("metadata snapshot: %v", err)
+	}
+	snap.metadataBlocks = live.metadataBlocks
+	snap.dataBlocks = live.dataBlocks
+	m.sb = snap
+	return m, nil
+}
+
+// DataBlockSize returns the chunk size of the pool in bytes.
+func (m *Metadata) DataBlockSize() int64 {
+	return int64(m.sb.dataBlockSize) << 9
+}
+
+func (m *Metadata) readBlock(b uint64) ([]byte, error) {
+	if m.sb.metadataBlocks > 0 && b >= m.sb.metadataBlocks {
+		return nil, fmt.Errorf("metadata block %d out of range, the metadata has %d blocks", b, m.sb.metadataBlocks)
+	}
+	buf := directio.AlignedBlock(MetadataBlockSize)
+	if _, err := m.r.ReadAt(buf, int64(b)*MetadataBlockSize); err != nil {
+		return nil, fmt.Errorf("read metadata block %d: %v", b, err)
+	}
+	return buf, nil
+}
+
+func (m *Metadata) readSuperblock(b uint64) (superblock, error) {
+	buf, err := m.readBlock(b)
+	if err != nil {
+		return superblock{}, err
+	}
+	le := binary.LittleEndian
+	if csum := metadataChecksum(buf, superblockCsumXor); le.Uint32(buf[0:]) != csum {
+		return superblock{}, fmt.Errorf("superblock %d: bad checksum", b)
+	}
+	if le.Uint64(buf[8:]) != b {
+		return superblock{}, fmt.Errorf("superblock %d: claims to be at block %d", b, le.Uint64(buf[8:]))
+	}
+	if le.Uint64(buf[32:]) != superblockMagic {
+		return superblock{}, fmt.Errorf("superblock %d: bad magic, not thin pool metadata", b)
+	}
+	if v := le.Uint32(buf[40:]); v < 1 || v > 2 {
+		return superblock{}, fmt.Errorf("superblock %d: unsupported metadata version %d", b, v)
+	}
+	if s := le.Uint32(buf[340:]); s != MetadataBlockSize>>9 {
+		return superblock{}, fmt.Errorf("superblock %d: unsupported metadata block size of %d sectors", b, s)
+	}
+	sb := superblock{
+		time:              le.Uint32(buf[44:]),
+		transactionId:     le.Uint64(buf[48:]),
+		heldRoot:          le.Uint64(buf[56:]),
+		dataBlocks:        le.Uint64(buf[64:]), // nr_blocks of the data space map root
+		dataMappingRoot:   le.Uint64(buf[320:]),
+		deviceDetailsRoot: le.Uint64(buf[328:]),
+		dataBlockSize:     le.Uint32(buf[336:]),
+		// metadata_nr_blocks is not updated when the metadata grows,
+		// nr_blocks of the metadata space map root is
+		metadataBlocks: le.Uint64(buf[192:]),
+	}
+	if sb.dataBlockSize == 0 {
+		return superblock{}, fmt.Errorf("superblock %d: data block size is 0", b)
+	}
+	return sb, nil
+}
+
+// btreeNode is a validated node of a persistent-data btree.
+type btreeNode struct {
+	b         []byte
+	leaf      bool
+	nr        int
+	max       int
+	valueSize int
+}
+
+func (n *btreeNode) key(i int) uint64 {
+	return binary.LittleEndian.Uint64(n.b[nodeHeaderSize+8*i:])
+}
+
+func (n *btreeNode) value(i int) []byte {
+	off := nodeHeaderSize + 8*n.max + n.valueSize*i
+	return n.b[off : off+n.valueSize]
+}
+
+// readNode reads the btree node at block b, whose leaves hold values of
+// valueSize bytes.
+func (m *Metadata) readNode(b uint64, valueSize int) (*btreeNode, error) {
+	buf, err := m.readBlock(b)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if csum := metadataChecksum(buf, btreeCsumXor); le.Uint32(buf[0:]) != csum {
+		return nil, fmt.Errorf("btree node %d: bad checksum", b)
+	}
+	if le.Uint64(buf[8:]) != b {
+		return nil, fmt.Errorf("btree node %d: claims to be at block %d", b, le.Uint64(buf[8:]))
+	}
+	n := &btreeNode{
+		b:         buf,
+		nr:        int(le.Uint32(buf[16:])),
+		max:       int(le.Uint32(buf[20:])),
+		valueSize: int(le.Uint32(buf[24:])),
+	}
+	switch le.Uint32(buf[4:]) {
+	case internalNode:
+		if n.valueSize != 8 {
+			return nil, fmt.Errorf("btree node %d: internal node with values of %d bytes", b, n.valueSize)
+		}
+	case leafNode:
+		n.leaf = true
+		if n.valueSize != valueSize {
+			return nil, fmt.Errorf("btree node %d: values of %d bytes, expected %d", b, n.valueSize, valueSize)
+		}
+	default:
+		return nil, fmt.Errorf("btree node %d: bad flags %#x", b, le.Uint32(buf[4:]))
+	}
+	if n.max == 0 || nodeHeaderSize+n.max*(8+n.valueSize) > MetadataBlockSize || n.nr > n.max {
+		return nil, fmt.Errorf("btree node %d: %d of at most %d entries do not fit the block", b, n.nr, n.max)
+	}
+	for i := 1; i < n.nr; i++ {
+		if n.key(i-1) >= n.key(i) {
+			return nil, fmt.Errorf("btree node %d: keys out of order", b)
+		}
+	}
+	return n, nil
+}
+
+// lookup returns the value of key in the btree at root, nil if the key
+// is not in it.
+func (m *Metadata) lookup(root, key uint64, valueSize int) ([]byte, error) {
+	b := root
+	for depth := 0; depth < maxBtreeDepth; depth++ {
+		n, err := m.readNode(b, valueSize)
+		if err != nil {
+			return nil, err
+		}
+		// the last entry whose key is not above key
+		i := n.nr - 1
+		for i >= 0 && n.key(i) > key {
+			i--
+		}
+		if i < 0 {
+			return nil, nil
+		}
+		if n.leaf {
+			if n.key(i) != key {
+				return nil, nil
+			}
+			return n.value(i), nil
+		}
+		b = binary.LittleEndian.Uint64(n.value(i))
+	}
+	return nil, fmt.Errorf("btree at %d is deeper than %d levels", root, maxBtreeDepth)
+}
+
+type iterFrame struct {
+	n *btreeNode
+	i int
+}
+
+// btreeIter walks the leaf entries of a btree in key order.
+type btreeIter struct {
+	m         *Metadata
+	valueSize int
+	stack     []iterFrame
+	started   bool
+	last      uint64
+}
+
+func (m *Metadata) iterate(root uint64, valueSize int) (*btreeIter, error) {
+	n, err := m.readNode(root, valueSize)
+	if err != nil {
+		return nil, err
+	}
+	return &btreeIter{m: m, valueSize: valueSize, stack: []iterFrame{{n: n}}}, nil
+}
+
+// next returns the next key and its value, ok is false past the last.
+func (it *btreeIter) next() (key uint64, value []byte, ok bool, err error) {
+	for len(it.stack) > 0 {
+		top := &it.stack[len(it.stack)-1]
+		if top.i >= top.n.nr {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		i := top.i
+		top.i++
+		if top.n.leaf {
+			key = top.n.key(i)
+			if it.started && key <= it.last {
+				return 0, nil, false, fmt.Errorf("btree keys out of order at key %d", key)
+			}
+			it.started, it.last = true, key
+			return key, top.n.value(i), true, nil
+		}
+		if len(it.stack) >= maxBtreeDepth {
+			return 0, nil, false, fmt.Errorf("btree is deeper than %d levels", maxBtreeDepth)
+		}
+		n, err := it.m.readNode(binary.LittleEndian.Uint64(top.n.value(i)), it.valueSize)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		it.stack = append(it.stack, iterFrame{n: n})
+	}
+	return 0, nil, false, nil
+}
+
+// mappingIter walks the mappings of one thin device in origin order.
+type mappingIter struct {
+	it         *btreeIter
+	dataBlocks uint64
+}
+
+type blockMapping struct {
+	origin, data int64
+	time         uint32
+}
+
+func (mi *mappingIter) next() (blockMapping, bool, error) {
+	key, value, ok, err := mi.it.next()
+	if !ok || err != nil {
+		return blockMapping{}, false, err
+	}
+	v := binary.LittleEndian.Uint64(value)
+	data := v >> 24
+	if key >= 1<<62 || (mi.dataBlocks > 0 && data >= mi.dataBlocks) {
+		return blockMapping{}, false, fmt.Errorf("bad mapping of block %d to data block %d", key, data)
+	}
+	return blockMapping{origin: int64(key), data: int64(data), time: uint32(v & (1<<24 - 1))}, true, nil
+}
+
+// mappings returns an iterator over the mappings of thin device dev.
+func (m *Metadata) mappings(dev int64) (*mappingIter, error) {
+	v, err := m.lookup(m.sb.dataMappingRoot, uint64(dev), 8)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("thin device %d not found in metadata", dev)
+	}
+	it, err := m.iterate(binary.LittleEndian.Uint64(v), mappingValueSize)
+	if err != nil {
+		return nil, fmt.Errorf("thin device %d: %v", dev, err)
+	}
+	return &mappingIter{it: it, dataBlocks: m.sb.dataBlocks}, nil
+}
+
+// Delta compares the mappings of thin devices layer and parent like
+// thin_delta --snap1 layer --snap2 parent: blocks mapped by layer only are
+// left_only, by parent only right_only, and blocks mapped by both are the
+// same if they share their data block and different otherwise.
+func (m *Metadata) Delta(layer, parent int64) (*DeltaBlocks, error) {
+	left, err := m.mappings(layer)
+	if err != nil {
+		return nil, err
+	}
+	right, err := m.mappings(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := &DeltaBlocks{}
+	l, lok, err := left.next()
+	if err != nil {
+		return nil, err
+	}
+	r, rok, err := right.next()
+	if err != nil {
+		return nil, err
+	}
+	for lok || rok {
+		switch {
+		case lok && (!rok || l.origin < r.origin):
+			delta.Add(DeltaOpCreate, l.origin)
+			l, lok, err = left.next()
+		case rok && (!lok || r.origin < l.origin):
+			delta.Add(DeltaOpDelete, r.origin)
+			r, rok, err = right.next()
+		default:
+			if l.data == r.data {
+				delta.Add(DeltaOpIgnore, l.origin)
+			} else {
+				delta.Add(DeltaOpUpdate, l.origin)
+			}
+			l, lok, err = left.next()
+			if err == nil {
+				r, rok, err = right.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return delta, nil
+}
+
+// Device returns the details and mappings of thin device dev like
+// thin_dump --dev-id dev, runs of consecutive blocks as range mappings.
+func (m *Metadata) Device(dev int64) (*Device, error) {
+	v, err := m.lookup(m.sb.deviceDetailsRoot, uint64(dev), detailsValueSize)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("thin device %d not found in metadata", dev)
+	}
+	le := binary.LittleEndian
+	d := &Device{
+		DevId:        dev,
+		MappedBlocks: int64(le.Uint64(v[0:])),
+		Transaction:  int64(le.Uint64(v[8:])),
+		CreateTime:   int64(le.Uint32(v[16:])),
+		SnapTime:     int64(le.Uint32(v[20:])),
+	}
+
+	it, err := m.mappings(dev)
+	if err != nil {
+		return nil, err
+	}
+	var run RangeMapping
+	flush := func() {
+		switch {
+		case run.Length == 1:
+			d.SingleMappings = append(d.SingleMappings, SingleMapping{OriginBlock: run.OriginBegin, DataBlock: run.DataBegin, Time: run.Time})
+		case run.Length > 1:
+			d.RangeMapping = append(d.RangeMapping, run)
+		}
+	}
+	for {
+		bm, ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if run.Length > 0 && bm.origin == run.OriginBegin+run.Length && bm.data == run.DataBegin+run.Length && int64(bm.time) == run.Time {
+			run.Length++
+			continue
+		}
+		flush()
+		run = RangeMapping{OriginBegin: bm.origin, DataBegin: bm.data, Length: 1, Time: int64(bm.time)}
+	}
+	flush()
+	return d, nil
+}
@@ -0,0 +1,219 @@
+package thindelta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// image builds pool metadata holding the devices of testdata/thin_dump.xml
+// but device 7.
+type image struct{ b []byte }
+
+func (im *image) block(n int) []byte {
+	for len(im.b) < (n+1)*MetadataBlockSize {
+		im.b = append(im.b, make([]byte, MetadataBlockSize)...)
+	}
+	return im.b[n*MetadataBlockSize : (n+1)*MetadataBlockSize]
+}
+
+func (im *image) sb(n int, held uint64) {
+	b := im.block(n)
+	le := binary.LittleEndian
+	le.PutUint64(b[8:], uint64(n))
+	le.PutUint64(b[32:], superblockMagic)
+	le.PutUint32(b[40:], 2)
+	le.PutUint64(b[56:], held)
+	if held != 0 {
+		le.PutUint64(b[64:], 1000)
+		le.PutUint64(b[192:], 64)
+	}
+	le.PutUint64(b[320:], 3)
+	le.PutUint64(b[328:], 2)
+	le.PutUint32(b[336:], 128)
+	le.PutUint32(b[340:], 8)
+	le.PutUint64(b[344:], 64)
+	le.PutUint32(b[0:], metadataChecksum(b, superblockCsumXor))
+}
+
+func (im *image) node(n int, leaf bool, vs int, keys []uint64, vals [][]byte) {
+	b := im.block(n)
+	le := binary.LittleEndian
+	max := (MetadataBlockSize - nodeHeaderSize) / (8 + vs)
+	if leaf {
+		le.PutUint32(b[4:], leafNode)
+	} else {
+		le.PutUint32(b[4:], internalNode)
+	}
+	le.PutUint64(b[8:], uint64(n))
+	le.PutUint32(b[16:], uint32(len(keys)))
+	le.PutUint32(b[20:], uint32(max))
+	le.PutUint32(b[24:], uint32(vs))
+	for i, k := range keys {
+		le.PutUint64(b[nodeHeaderSize+8*i:], k)
+		copy(b[nodeHeaderSize+8*max+vs*i:], vals[i])
+	}
+	le.PutUint32(b[0:], metadataChecksum(b, btreeCsumXor))
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func mapping(data uint64) []byte { return u64(data<<24 | 5) }
+
+func mappingLeaf(im *image, n int, m map[uint64]uint64, keys []uint64) {
+	vals := [][]byte{}
+	for _, k := range keys {
+		vals = append(vals, mapping(m[k]))
+	}
+	im.node(n, true, 8, keys, vals)
+}
+
+func testImage() *image {
+	im := &image{}
+	im.sb(0, 1)
+	im.sb(1, 0)
+	det := make([]byte, 24)
+	binary.LittleEndian.PutUint64(det, 6)
+	det2 := make([]byte, 24)
+	binary.LittleEndian.PutUint64(det2, 7)
+	im.node(2, true, 24, []uint64{1, 2}, [][]byte{det, det2})
+	im.node(3, true, 8, []uint64{1, 2}, [][]byte{u64(4), u64(5)})
+	// dev 1 (parent): 0..3 -> 10..13, 10 -> 50, 20 -> 60
+	parent := map[uint64]uint64{0: 10, 1: 11, 2: 12, 3: 13, 10: 50, 20: 60}
+	mappingLeaf(im, 4, parent, []uint64{0, 1, 2, 3, 10, 20})
+	// dev 2 (layer): 0,1 same, 2 changed, 5,6 new, 20 same, 21 new; 3, 10 deleted
+	layer := map[uint64]uint64{0: 10, 1: 11, 2: 99, 5: 100, 6: 101, 20: 60, 21: 61}
+	im.node(5, false, 8, []uint64{0, 5}, [][]byte{u64(6), u64(7)})
+	mappingLeaf(im, 6, layer, []uint64{0, 1, 2})
+	mappingLeaf(im, 7, layer, []uint64{5, 6, 20, 21})
+	return im
+}
+
+// The blocks of image are sealed with metadataChecksum, which is checked
+// against values computed apart from the package: the CRC-32C check value
+// of RFC 3720 and a bitwise CRC-32C of empty blocks.
+func TestMetadataChecksum(t *testing.T) {
+	check := append(make([]byte, 4), "123456789"...)
+	if got := metadataChecksum(check, 0); got != ^uint32(0xe3069283) {
+		t.Errorf("check value: %#x", got)
+	}
+	empty := make([]byte, MetadataBlockSize)
+	if got := metadataChecksum(empty, superblockCsumXor); got != 0x58cfd397 {
+		t.Errorf("empty superblock: %#x", got)
+	}
+	if got := metadataChecksum(empty, btreeCsumXor); got != 0x58cc7e82 {
+		t.Errorf("empty btree node: %#x", got)
+	}
+	// the checksum field itself is not covered
+	empty[0] = 1
+	if got := metadataChecksum(empty, btreeCsumXor); got != 0x58cc7e82 {
+		t.Errorf("checksum field covered: %#x", got)
+	}
+}
+
+func TestMetadataDelta(t *testing.T) {
+	im := testImage()
+	m, err := NewMetadata(bytes.NewReader(im.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DataBlockSize() != 64<<10 {
+		t.Fatal(m.DataBlockSize())
+	}
+	d, err := m.Delta(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := readThinDelta(t); !reflect.DeepEqual(d, want) {
+		t.Fatalf("native delta %+v, thin_delta %+v", d, want)
+	}
+	devs, err := decodeDump(t, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range devs {
+		dev, err := m.Device(want.DevId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := CompareDevices(dev, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ChangedBlocks() != 0 {
+			t.Fatalf("device %d differs from thin_dump: %+v", want.DevId, got)
+		}
+	}
+	dev, err := m.Device(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.MappedBlocks != 6 || len(dev.RangeMapping) != 1 || dev.RangeMapping[0].Length != 4 || len(dev.SingleMappings) != 2 || dev.SingleMappings[1].DataBlock != 60 {
+		t.Fatalf("%+v", dev)
+	}
+	if err := dev.ExpandRangeMappings(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Delta(3, 1); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataCorrupt(t *testing.T) {
+	im := testImage()
+	im.b[7*MetadataBlockSize+100] ^= 1
+	m, err := NewMetadata(bytes.NewReader(im.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Delta(2, 1); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatal(err)
+	}
+	im = testImage()
+	im.sb(0, 0)
+	if _, err := NewMetadata(bytes.NewReader(im.b)); err == nil {
+		t.Fatal("no snapshot accepted")
+	}
+	im = testImage()
+	b := im.block(6)
+	binary.LittleEndian.PutUint32(b[4:], internalNode|leafNode)
+	binary.LittleEndian.PutUint32(b[0:], metadataChecksum(b, btreeCsumXor))
+	if m, err = NewMetadata(bytes.NewReader(im.b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Delta(2, 1); err == nil || !strings.Contains(err.Error(), "bad flags") {
+		t.Fatal(err)
+	}
+	// data block beyond the data space map
+	im = testImage()
+	mappingLeaf(im, 4, map[uint64]uint64{0: 5000}, []uint64{0})
+	if m, err = NewMetadata(bytes.NewReader(im.b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Delta(2, 1); err == nil {
+		t.Fatal("bad data block accepted")
+	}
+}
+
+func TestDumpDeltaMatchesNative(t *testing.T) {
+	m, err := NewMetadata(bytes.NewReader(testImage().b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, _ := m.Device(2)
+	parent, _ := m.Device(1)
+	got, err := CompareDevices(layer, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := m.Delta(2, 1)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%+v\n%+v", got, want)
+	}
+}
@@ -26,6 +26,13 @@ func CheckBase(devpath string, blocksize int64, baseBlocks []BlockHash) (bool, e
 		return false, err
 	}
 	defer devFile.Close()
+	return CheckBaseReader(devFile, blocksize, baseBlocks)
+}
+
+// CheckBaseReader is CheckBase reading the base volume from r, which
+// must accept aligned reads if it is opened for direct I/O.
+func CheckBaseReader(r io.ReaderAt, blocksize int64, baseBlocks []BlockHash) (bool, error) {
+
 	buf := directio.AlignedBlock(int(blocksize))
 
 	for _, block := range baseBlocks {
@@ -34,10 +41,7 @@ func CheckBase(devpath string, blocksize int64, baseBlocks []BlockHash) (bool, e
 		//	fmt.Fprintln(os.Stderr, addr, length)
 		hash := crc32.NewIEEE()
 		for offset := int64(0); offset < length; offset++ {
-			if _, err := devFile.Seek((addr+offset)*blocksize, os.SEEK_SET); err != nil {
-				return false, err
-			}
-			if _, err := io.ReadFull(devFile, buf); err != nil {
+			if _, err := r.ReadAt(buf, (addr+offset)*blocksize); err != nil {
 				return false, err
 			}
 			hash.Write(buf)
@@ -51,7 +55,12 @@ func CheckBase(devpath string, blocksize int64, baseBlocks []BlockHash) (bool, e
 	return true, nil
 }
 
-func GenChecksum(devpath string, blocksize int64, blocks []DeltaEntry, level int) ([]BlockHash, error) {
+// GenChecksum hashes chunks of the base volume at devpath, for the receiver
+// to check that it patches the same base. The ranges of blocks, same ones
+// included, are joined into runs of adjacent chunks. Level 1 hashes the
+// first chunk of the first run, level 2 the first chunk of every run and
+// level 3 the first two chunks of every run.
+func GenChecksum(devpath string, blocksize int64, blocks ExtentIterator, level int) ([]BlockHash, error) {
 
 	if level == 0 {
 		return nil, nil
@@ -61,54 +70,66 @@ func GenChecksum(devpath string, blocksize int64, blocks []DeltaEntry, level int
 		return nil, err
 	}
 	defer devFile.Close()
+	return GenChecksumReader(devFile, blocksize, blocks, level)
+}
+
+// GenChecksumReader is GenChecksum reading the base volume from r.
+func GenChecksumReader(r io.ReaderAt, blocksize int64, blocks ExtentIterator, level int) ([]BlockHash, error) {
+
+	if level == 0 {
+		return nil, nil
+	}
 	buf := directio.AlignedBlock(int(blocksize))
 
-	//blockId := ""
 	ret := []BlockHash{}
-	p := 0
+	hashRun := func(begin, length int64) error {
+		n := int64(1)
+		if level == 3 && length > 1 {
+			n = 2
+		}
+		hash := crc32.NewIEEE()
+		for i := int64(0); i < n; i++ {
+			if _, err := r.ReadAt(buf, (begin+i)*blocksize); err != nil {
+				return err
+			}
+			hash.Write(buf)
+		}
+		ret = append(ret, BlockHash{
+			Offset:   begin * blocksize >> 9,
+			Length:   n * blocksize >> 9,
+			HashType: "CRC32",
+			Value:    fmt.Sprintf("%x", hash.Sum32()),
+		})
+		return nil
+	}
 
+	var begin, length int64 // current run
 	for {
-		//fmt.Fprintln(os.Stderr, p)
-		if p >= len(blocks) {
+		e, err := blocks.Next()
+		if err == io.EOF {
 			break
 		}
-		e := blocks[p]
-
-		if e.OriginBlock == 0 || e.OriginBlock-blocks[p-1].OriginBlock > 1 {
-			q := p
-			hash := crc32.NewIEEE()
-			for {
-				addr := blocks[q].OriginBlock
-				if _, err := devFile.Seek(addr*blocksize, os.SEEK_SET); err != nil {
-					return nil, err
-				}
-				if _, err := io.ReadFull(devFile, buf); err != nil {
-					return nil, err
-				}
-				hash.Write(buf)
-				q++
-				if q >= len(blocks) || blocks[q].OriginBlock-e.OriginBlock > 1 {
-					break
-				}
-				if level != 3 {
-					break
-				}
-
+		if err != nil {
+			return nil, err
+		}
+		if length > 0 && begin+length == e.OriginBegin {
+			length += e.Length
+			continue
+		}
+		if length > 0 {
+			if err := hashRun(begin, length); err != nil {
+				return nil, err
 			}
-			ret = append(ret, BlockHash{
-				Offset:   e.OriginBlock * blocksize >> 9,
-				Length:   int64(q-p) * blocksize >> 9,
-				HashType: "CRC32",
-				Value:    fmt.Sprintf("%x", hash.Sum32()),
-			})
 			if level == 1 {
-				break
+				return ret, nil
 			}
-			p = q
-		} else {
-			p++
+		}
+		begin, length = e.OriginBegin, e.Length
+	}
+	if length > 0 {
+		if err := hashRun(begin, length); err != nil {
+			return nil, err
 		}
 	}
-
 	return ret, nil
 }
@@ -4,8 +4,10 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os/exec"
-	"sort"
+	"strconv"
 )
 
 func sendThinPoolMessage(tpoolDev, message string) error {
@@ -22,85 +24,206 @@ func sendThinPoolMessage(tpoolDev, message string) error {
 	return nil
 }
 
-func Delta(tpoolDev, tmetaDev string, layer_id, parent_id int64) ([]DeltaEntry, int64, error) {
+// reserveMetadataSnap reserves the metadata snapshot of the pool, which
+// thin_delta, thin_dump and Metadata read.
+func reserveMetadataSnap(tpoolDev string) error {
 	// just try to release the metadata snap in case of error; ignore the result
-	sendThinPoolMessage(tpoolDev, "release_metadata_snap")
+	releaseMetadataSnap(tpoolDev)
 
 	if err := sendThinPoolMessage(tpoolDev, "reserve_metadata_snap"); err != nil {
-		return nil, -1, errors.New("can not send reserve_metadata_snap to tpool: " + err.Error())
+		return errors.New("can not send reserve_metadata_snap to tpool: " + err.Error())
 	}
-	defer sendThinPoolMessage(tpoolDev, "release_metadata_snap")
+	return nil
+}
+
+func releaseMetadataSnap(tpoolDev string) {
+	sendThinPoolMessage(tpoolDev, "release_metadata_snap")
+}
+
+func Delta(tpoolDev, tmetaDev string, layer_id, parent_id int64) (*DeltaBlocks, error) {
+	if err := reserveMetadataSnap(tpoolDev); err != nil {
+		return nil, err
+	}
+	defer releaseMetadataSnap(tpoolDev)
 
 	path, err := exec.LookPath("thin_delta")
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
 
 	snap1 := fmt.Sprintf("%d", layer_id)
 	snap2 := fmt.Sprintf("%d", parent_id)
 	cmd := exec.Command(path, "-m", "--snap1", snap1, "--snap2", snap2, tmetaDev)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// ranges are decoded as they come, the document is never held
+	delta, err := ReadDeltaBlocks(NewDeltaDecoder(out))
+	if err != nil {
+		io.Copy(ioutil.Discard, out)
+	}
+	if werr := cmd.Wait(); werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+// Dump returns the mappings of thin device dev_id, read by thin_dump from
+// the metadata snapshot.
+func Dump(tpoolDev, tmetaDev string, dev_id int64) (*Device, error) {
+	if err := reserveMetadataSnap(tpoolDev); err != nil {
+		return nil, err
+	}
+	defer releaseMetadataSnap(tpoolDev)
+
+	path, err := exec.LookPath("thin_dump")
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, "-m", "--dev-id", fmt.Sprintf("%d", dev_id), tmetaDev)
 
 	result, err := cmd.Output()
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
-	v := DeltaSuperBlock{}
+	v := SuperBlock{}
 	if err = xml.Unmarshal(result, &v); err != nil {
-		return nil, -1, err
+		return nil, err
 	}
-	ret, diffCount := ExpandBlocks(&v.DiffResult)
-	return ret, diffCount, nil
-	// }
-	// return &v.DiffResult, nil
+	dev, ok := v.FindDevice(dev_id)
+	if !ok {
+		return nil, fmt.Errorf("thin device %d not found in metadata", dev_id)
+	}
+	return dev, nil
 }
 
-func ExpandBlocks(deltablocks *DeltaBlocks) ([]DeltaEntry, int64) {
+// DumpDelta is Delta for thin-provisioning-tools without thin_delta, or
+// whose thin_delta lacks --snap1 and --snap2: the whole metadata snapshot
+// is dumped by thin_dump and the mappings of both devices are compared by
+// CompareDeviceBlocks.
+func DumpDelta(tpoolDev, tmetaDev string, layer_id, parent_id int64) (*DeltaBlocks, error) {
+	if err := reserveMetadataSnap(tpoolDev); err != nil {
+		return nil, err
+	}
+	defer releaseMetadataSnap(tpoolDev)
 
-	entries := []DeltaEntry{}
-	cnt := int64(0)
-	//checkEntries :=[]DeltaEntry{}
-	for _, m := range deltablocks.DifferentMappings {
-		for i := int64(0); i < m.Length; i++ {
-			entries = append(entries, DeltaEntry{
-				OriginBlock: m.Begin + i,
-				OpType:      DeltaOpUpdate,
-			})
-		}
+	path, err := exec.LookPath("thin_dump")
+	if err != nil {
+		return nil, err
 	}
-	for _, m := range deltablocks.LeftOnlyMappings {
-		for i := int64(0); i < m.Length; i++ {
-			entries = append(entries, DeltaEntry{
-				OriginBlock: m.Begin + i,
-				OpType:      DeltaOpCreate,
-			})
+
+	cmd := exec.Command(path, "-m", tmetaDev)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	devs, err := DecodeDevices(out, layer_id, parent_id)
+	if err != nil {
+		io.Copy(ioutil.Discard, out)
+	}
+	if werr := cmd.Wait(); werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return CompareDevices(devs[0], devs[1])
+}
+
+// DecodeDevices decodes the devices ids from the output of thin_dump,
+// skipping the mappings of all other devices.
+func DecodeDevices(r io.Reader, ids ...int64) ([]*Device, error) {
+	devs := make([]*Device, len(ids))
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "device" {
+			continue
+		}
+		id := int64(-1)
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "dev_id" {
+				if id, err = strconv.ParseInt(attr.Value, 10, 64); err != nil {
+					return nil, fmt.Errorf("thin_dump: bad dev_id of <device>: %v", err)
+				}
+			}
+		}
+		i := 0
+		for i < len(ids) && ids[i] != id {
+			i++
+		}
+		if i == len(ids) {
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dev := &Device{}
+		if err := d.DecodeElement(dev, &start); err != nil {
+			return nil, err
+		}
+		devs[i] = dev
 	}
-	for _, m := range deltablocks.RightOnlyMappings {
-		for i := int64(0); i < m.Length; i++ {
-			entries = append(entries, DeltaEntry{
-				OriginBlock: m.Begin + i,
-				OpType:      DeltaOpDelete,
-			})
+	for i, dev := range devs {
+		if dev == nil {
+			return nil, fmt.Errorf("thin device %d not found in metadata", ids[i])
 		}
 	}
-	cnt = int64(len(entries))
-	for _, m := range deltablocks.SameMappings {
-		for i := int64(0); i < m.Length; i++ {
-			entries = append(entries, DeltaEntry{
-				OriginBlock: m.Begin + i,
-				OpType:      DeltaOpIgnore,
-			})
+	return devs, nil
+}
+
+// CompareDevices returns the delta of device layer to parent, the same
+// as thin_delta --snap1 layer --snap2 parent.
+func CompareDevices(layer, parent *Device) (*DeltaBlocks, error) {
+	entries, err := CompareDeviceBlocks(parent, layer)
+	if err != nil {
+		return nil, err
+	}
+	delta := &DeltaBlocks{}
+	for _, e := range entries {
+		delta.Add(e.OpType, e.OriginBlock)
+	}
+	return delta, nil
+}
+
+// Extents returns the changed ranges sorted by origin block, merged as
+// by Changes.
+func (d *DeltaBlocks) Extents() []DeltaExtent {
+	extents := []DeltaExtent{}
+	it := Changes(d.Ranges())
+	for {
+		e, err := it.Next()
+		if err != nil {
+			// ranges of a DeltaBlocks never fail
+			return extents
 		}
+		extents = append(extents, e)
 	}
-	sort.Sort(entryByOrigin(entries))
-	// id := []int64{}
-	// for _, e := range entries {
-	// 	id = append(id, e.OriginBlock)
-	// }
-	// fmt.Fprintln(os.Stderr, "%d\n", id)
-	return entries, cnt
 }
 
+// CompareDeviceBlocks compares the mappings of dst to those of src, chunk
+// by chunk in origin order. Chunks mapped by both are DeltaOpIgnore if they
+// share their data block, like the same ranges of thin_delta.
 func CompareDeviceBlocks(src, dst *Device) ([]DeltaEntry, error) {
 	entries := make([]DeltaEntry, 0, 256)
 
@@ -142,12 +265,14 @@ func CompareDeviceBlocks(src, dst *Device) ([]DeltaEntry, error) {
 			})
 			i++
 		case s.OriginBlock == d.OriginBlock:
+			op := DeltaOpIgnore
 			if s.DataBlock != d.DataBlock {
-				entries = append(entries, DeltaEntry{
-					OriginBlock: d.OriginBlock,
-					OpType:      DeltaOpUpdate,
-				})
+				op = DeltaOpUpdate
 			}
+			entries = append(entries, DeltaEntry{
+				OriginBlock: d.OriginBlock,
+				OpType:      op,
+			})
 			i++
 			j++
 		case s.OriginBlock > d.OriginBlock:
@@ -0,0 +1,55 @@
+package lvbackup
+
+import (
+	"fmt"
+	"os"
+)
+
+// writtenBlock is kept for every block written when the patch is verified.
+type writtenBlock struct {
+	Offset, Length int64
+	Sum            uint32 // blockChecksum of the data, unused for a zero range
+	Zero           bool
+}
+
+func newWrittenBlock(block streamBlock) writtenBlock {
+	if block.Data == nil {
+		return writtenBlock{Offset: block.Offset, Length: block.Length, Zero: true}
+	}
+	return writtenBlock{Offset: block.Offset, Length: block.Length, Sum: blockChecksum(block.Data)}
+}
+
+// verifyBlocks flushes the target and reads back every block written,
+// comparing it with the checksum of the stream data. Mismatching blocks
+// are reported on stderr.
+func (sr *streamRecver) verifyBlocks() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.dev == nil {
+		return fmt.Errorf("target volume is closed")
+	}
+	if err := sr.dev.Sync(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nverifying...")
+	var buf []byte
+	bad := 0
+	bytes := int64(0)
+	for _, b := range sr.written {
+		buf = blockBuffer(buf, int(b.Length))
+		if _, err := sr.dev.ReadAt(buf, b.Offset); err != nil {
+			return err
+		}
+		if b.Zero && !isZeroBlock(buf) || !b.Zero && blockChecksum(buf) != b.Sum {
+			fmt.Fprintf(os.Stderr, "mismatch at offset %d (%d bytes)\n", b.Offset, b.Length)
+			bad++
+		}
+		bytes += b.Length
+	}
+	if bad > 0 {
+		return fmt.Errorf("verification failed: %d of %d blocks mismatch", bad, len(sr.written))
+	}
+	fmt.Printf("Verified %d blocks (%d bytes).\n", len(sr.written), bytes)
+	return nil
+}
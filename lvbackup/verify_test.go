@@ -0,0 +1,39 @@
+package lvbackup
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBlocks(t *testing.T) {
+	f, blocks, _ := applyTarget(t, 16)
+	blocks = append(blocks[:3], streamBlock{Offset: 3 * 4096, Length: 2 * 4096, Data: bytes.Repeat([]byte{7}, 2*4096)})
+	sr := &streamRecver{jobs: 2, dev: f, verify: true, header: streamHeader{BlockSize: 4096, BlockCount: 5}}
+	if err := sr.applyBlocks(&fakeDecoder{blocks: blocks}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.verifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a zeroed chunk which reads back data and a write record of two
+	// chunks changed in the second one
+	f.WriteAt([]byte{9}, 100)
+	f.WriteAt([]byte{9}, 4*4096+7)
+	if err := sr.verifyBlocks(); err == nil || err.Error() != "verification failed: 2 of 4 blocks mismatch" {
+		t.Fatalf("got %v", err)
+	}
+	f.WriteAt([]byte{0}, 100)
+	f.WriteAt([]byte{7}, 4*4096+7)
+	if err := sr.verifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sr.closeDev(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.verifyBlocks(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("closed target: %v", err)
+	}
+}
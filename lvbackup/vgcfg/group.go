@@ -17,15 +17,15 @@ type ThinPoolInfo struct {
 }
 
 type ThinLvInfo struct {
-	UUID string `json:"uuid"`
-	Name string `json:"name"`
-	Pool string `json:"pool"`
-	//	Tags          []string `json:"tags"`
-	Origin        string `json:"origin"`
-	TransactionId int64  `json:"tx_id"`
-	DeviceId      int64  `json:"dev_id"`
-	StartExtent   int64  `json:"start_extent"`
-	ExtentCount   int64  `json:"extent_count" `
+	UUID          string   `json:"uuid"`
+	Name          string   `json:"name"`
+	Pool          string   `json:"pool"`
+	Tags          []string `json:"tags"`
+	Origin        string   `json:"origin"`
+	TransactionId int64    `json:"tx_id"`
+	DeviceId      int64    `json:"dev_id"`
+	StartExtent   int64    `json:"start_extent"`
+	ExtentCount   int64    `json:"extent_count" `
 }
 
 func (t *ThinLvInfo) String() string {
@@ -82,15 +82,26 @@ func (g *Group) VarStringValue(key string) (string, bool) {
 	return s, ok
 }
 
-// func (g *Group) VarStringArrayValue(key string) ([]string, bool) {
-// 	v, ok := g.variables[key]
-// 	if !ok {
-// 		return []string{}, false
-// 	}
+func (g *Group) VarStringArrayValue(key string) ([]string, bool) {
+	v, ok := g.variables[key]
+	if !ok {
+		return []string{}, false
+	}
 
-// 	s, ok := v.([]string)
-// 	return s, ok
-// }
+	list, ok := v.([]interface{})
+	if !ok {
+		return []string{}, false
+	}
+	s := make([]string, 0, len(list))
+	for _, e := range list {
+		str, ok := e.(string)
+		if !ok {
+			return []string{}, false
+		}
+		s = append(s, str)
+	}
+	return s, true
+}
 
 func (g *Group) VarIntegerValue(key string) (int64, bool) {
 	v, ok := g.variables[key]
@@ -256,9 +267,9 @@ func (g *Group) ThinLvInfo() *ThinLvInfo {
 		info.Origin = val
 	}
 
-	// if val, ok := s1.VarStringArrayValue("tags"); ok {
-	// 	info.Tags = val
-	// }
+	if val, ok := g.VarStringArrayValue("tags"); ok {
+		info.Tags = val
+	}
 
 	info.Name = g.Name()
 	return &info
@@ -372,5 +383,5 @@ func (g *Group) ListThinLvInfo(filter func(*ThinLvInfo) bool) ([]*ThinLvInfo, bo
 }
 
 func (g *Group) String() string {
-	return fmt.Sprintf("Group %s Variables %#v SubGroups %#v", g.Name, g.variables, g.childs)
+	return fmt.Sprintf("Group %s Variables %#v SubGroups %#v", g.Name(), g.variables, g.childs)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/hyperblock/lvdiff/lvbackup"
+	"github.com/hyperblock/lvdiff/lvbackup/thindelta"
 
 	"github.com/spf13/cobra"
 )
@@ -27,14 +29,26 @@ func main() {
 	var vgname string
 	var vol0, vol1 string
 	var depth int32
+	var format int
+	var compress string
+	var maxExtent int64
+	var readDepth int
+	var deltaEngine string
+	var encrypt bool
+	var keyFile, passphraseFile string
+	var signKeyFile, sigFile string
+	var sourceFile, baseFile string
+	var chunkSize int64
+	var output string
+	var splitSize int64
 	//var output string
 	//	header := c_HEADER
 
 	rootCmd = &cobra.Command{
-		Use:   "lvdiff <volume_A> <volume_B>",
+		Use:   "lvdiff <volume_A> [<volume_B>]",
 		Short: "lvdiff is a tool to dump differential blocks of two thin volumes.",
 		Run: func(cmd *cobra.Command, args []string) {
-			if vgname == "" || len(args) < 2 {
+			if sourceFile == "" && (vgname == "" || len(args) < 1) {
 				fmt.Fprintf(os.Stderr, "Too few arguments.")
 				rootCmd.Usage()
 				return
@@ -61,18 +75,108 @@ func main() {
 				header = append(header, []byte(buf)...)
 			}
 
-			vol1, vol0 = args[0], args[1]
-			f := os.Stdout
+			// without volume_B, a full stream of volume_A is dumped
+			if len(args) > 0 {
+				vol1 = args[0]
+			}
+			if len(args) > 1 {
+				vol0 = args[1]
+			}
+			var f io.Writer = os.Stdout
+			var out, sigOut *lvbackup.StreamOutput
+			// os.Exit skips deferred calls, the temporary files are removed here
+			fail := func(code int, err interface{}) {
+				fmt.Fprintln(os.Stderr, err)
+				if out != nil {
+					out.Abort()
+				}
+				if sigOut != nil {
+					sigOut.Abort()
+				}
+				os.Exit(code)
+			}
+			if output != "" {
+				var err error
+				if out, err = lvbackup.CreateOutput(output, splitSize); err != nil {
+					fail(2, err)
+				}
+				f = out
+			} else if splitSize != 0 {
+				fail(-1, "--split-size needs --output")
+			}
 
 			sender, err := lvbackup.NewStreamSender(vgname, vol1, vol0, f, int(depth))
 
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return
+				fail(2, err)
+			}
+			if err := sender.SetScheme(format); err != nil {
+				fail(2, err)
+			}
+			algo, err := lvbackup.ParseCompression(compress)
+			if err != nil {
+				fail(2, err)
+			}
+			if err := sender.SetCompression(algo); err != nil {
+				fail(2, err)
+			}
+			if err := sender.SetMaxExtent(maxExtent); err != nil {
+				fail(2, err)
+			}
+			if err := sender.SetReadDepth(readDepth); err != nil {
+				fail(2, err)
+			}
+			engine, err := thindelta.ParseEngine(deltaEngine)
+			if err != nil {
+				fail(2, err)
+			}
+			sender.SetDeltaEngine(engine)
+			if sourceFile != "" {
+				if err := sender.SetImages(sourceFile, baseFile, chunkSize); err != nil {
+					fail(2, err)
+				}
+			} else if baseFile != "" {
+				fail(-1, "--base-file needs --source-file")
+			}
+			key, err := lvbackup.LoadStreamKey(keyFile, passphraseFile)
+			if err != nil {
+				fail(2, err)
+			}
+			if encrypt {
+				if key == nil {
+					fail(-1, "--encrypt needs --key-file or --passphrase-file")
+				}
+				sender.SetEncryption(key)
+			}
+			if signKeyFile != "" {
+				signKey, err := lvbackup.LoadSigningKey(signKeyFile)
+				if err != nil {
+					fail(2, err)
+				}
+				if sigFile == "" {
+					sender.SetSigning(signKey, nil)
+				} else {
+					// like the stream, the signatures appear only once complete
+					if sigOut, err = lvbackup.CreateOutput(sigFile, 0); err != nil {
+						fail(2, err)
+					}
+					sender.SetSigning(signKey, sigOut)
+				}
+			} else if sigFile != "" {
+				fail(-1, "--detach-signature needs --sign-key")
 			}
 			if err := sender.Run(header); err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return
+				fail(2, err)
+			}
+			if out != nil {
+				if err := out.Commit(); err != nil {
+					fail(2, err)
+				}
+			}
+			if sigOut != nil {
+				if err := sigOut.Commit(); err != nil {
+					fail(2, err)
+				}
 			}
 		},
 	}
@@ -84,6 +188,23 @@ func main() {
 														2 means random check, 
 														3 means scan all data blocks.`)
 
+	rootCmd.Flags().IntVarP(&format, "format", "", lvbackup.StreamSchemeV1, `stream format. 
+														1 means HYPERLAYER/1.0 (text sub-headers), 
+														2 means HYPERLAYER/2.0 (binary records).`)
+	rootCmd.Flags().StringVarP(&compress, "compress", "", "none", "compress block data with none, gzip, zstd or lz4. (need --format 2)")
+	rootCmd.Flags().Int64VarP(&maxExtent, "max-extent", "", lvbackup.DefaultMaxExtent, "max bytes of contiguous chunks sent in one record. (only for --format 2)")
+	rootCmd.Flags().IntVarP(&readDepth, "read-depth", "", lvbackup.DefaultReadDepth, "runs of chunks read ahead in parallel while the stream is written.")
+	rootCmd.Flags().StringVarP(&deltaEngine, "delta-engine", "", "auto", "read the pool metadata with thin_delta, dump (thin_dump only), native (built-in reader) or auto (each in turn).")
+	rootCmd.Flags().BoolVarP(&encrypt, "encrypt", "", false, "encrypt the stream with AES-256-GCM. (need --format 2)")
+	rootCmd.Flags().StringVarP(&keyFile, "key-file", "", "", "file holding the 32 byte encryption key (raw or hex).")
+	rootCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "file holding the passphrase the encryption key is derived from.")
+	rootCmd.Flags().StringVarP(&signKeyFile, "sign-key", "", "", "sign the stream with this Ed25519 private key (PKCS #8 PEM). (need --format 2)")
+	rootCmd.Flags().StringVarP(&sigFile, "detach-signature", "", "", "write the signatures to this file instead of the stream.")
+	rootCmd.Flags().StringVarP(&sourceFile, "source-file", "", "", "dump a raw image file instead of a thin volume.")
+	rootCmd.Flags().StringVarP(&baseFile, "base-file", "", "", "base image of --source-file for a delta stream.")
+	rootCmd.Flags().Int64VarP(&chunkSize, "chunk-size", "", 64<<10, "bytes in which image files are compared. (only for --source-file)")
+	rootCmd.Flags().StringVarP(&output, "output", "o", "", "write the stream to this file instead of standard output, which appears only once it is complete.")
+	rootCmd.Flags().Int64VarP(&splitSize, "split-size", "", 0, "split the --output stream into numbered segment files of at most this many bytes, listed by a manifest at --output.")
 	rootCmd.Flags().StringArrayVarP(&metaPairs, "meta", "", nil, "set metadata (format as '$key:$value').")
 	//rootCmd.Flags().StringArrayVarP(&value, "value", "", nil, "set value.")
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/hyperblock/lvdiff/lvbackup"
+
+	"fmt"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func main() {
+	var rootCmd *cobra.Command
+	var keyFile, passphraseFile string
+	var offset, length int64
+
+	rootCmd = &cobra.Command{
+		Use:   "lvinspect <stream_file>",
+		Short: "list the blocks of a HYPERLAYER/2.0 stream file, or read a volume range from it",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				fmt.Fprintln(os.Stderr, "too few arguments.")
+				cmd.Usage()
+				os.Exit(-1)
+			}
+			key, err := lvbackup.LoadStreamKey(keyFile, passphraseFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(-1)
+			}
+			sf, err := lvbackup.OpenStreamFile(args[0], key)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			defer sf.Close()
+
+			if length > 0 {
+				// copied in pieces, the range may be as large as the volume
+				if _, err := io.Copy(os.Stdout, io.NewSectionReader(sf, offset, length)); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(3)
+				}
+				return
+			}
+
+			headBuf, err := yaml.Marshal(sf.Header)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(3)
+			}
+			fmt.Printf("%s%s\n", headBuf, sf.Header.Meta)
+			for _, e := range sf.Index {
+				fmt.Printf("%c %X %X @%X\n", e.Type, e.Offset, e.Length, e.Pos)
+			}
+		},
+	}
+
+	rootCmd.Flags().StringVarP(&keyFile, "key-file", "", "", "key file of an encrypted stream")
+	rootCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "passphrase file of an encrypted stream")
+	rootCmd.Flags().Int64VarP(&offset, "offset", "", 0, "volume offset in bytes of the range to read")
+	rootCmd.Flags().Int64VarP(&length, "length", "", 0, "length in bytes of the range to read to standard output")
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(-1)
+	}
+
+	os.Exit(0)
+}
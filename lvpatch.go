@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/hyperblock/lvdiff/lvbackup"
 
@@ -13,28 +16,96 @@ import (
 func main() {
 	var rootCmd *cobra.Command
 	var flg bool
-	var vgname, baseLv, newLv string
+	var vgname, poolname, baseLv, newLv string
+	var keyFile, passphraseFile string
+	var trustedKeys, sigFile string
+	var requireSig bool
+	var stateFile string
+	var jobs int
+	var verify bool
+	var targetFile, baseFile string
+	var dryRun bool
+	var inPlace string
+	var input string
 
 	rootCmd = &cobra.Command{
-		Use:   "lvpatch <new_volume_name>",
-		Short: "create or update thin logcial volume with contents in standard input",
+		Use:   "lvpatch [<new_volume_name>]",
+		Short: "create or update thin logcial volume with contents in standard input or --input",
 		Run: func(cmd *cobra.Command, args []string) {
-			if len(vgname) == 0 || len(baseLv) == 0 {
-				fmt.Fprintln(os.Stderr, "volume group, thin pool and logical volume must be provided")
+			if len(vgname) == 0 && len(targetFile) == 0 {
+				fmt.Fprintln(os.Stderr, "volume group must be provided")
 				cmd.Usage()
 				os.Exit(-1)
 			}
-			if len(args) == 0 {
+			if len(inPlace) > 0 {
+				if len(args) > 0 || len(baseLv) > 0 || len(targetFile) > 0 || flg {
+					fmt.Fprintln(os.Stderr, "--in-place takes no new volume name, base volume, target file or --no-base-check")
+					os.Exit(-1)
+				}
+				newLv = inPlace
+			} else if len(args) > 0 {
+				newLv = args[0]
+			} else if len(targetFile) > 0 {
+				newLv = filepath.Base(targetFile)
+			} else {
 				fmt.Fprintln(os.Stderr, "too few arguments.")
 				cmd.Usage()
 				os.Exit(-1)
 			}
-			newLv = args[0]
-			recver, err := lvbackup.NewStreamRecver(vgname, "", baseLv, flg, os.Stdin)
+			key, err := lvbackup.LoadStreamKey(keyFile, passphraseFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(-1)
+			}
+			var in io.Reader = os.Stdin
+			if len(input) > 0 {
+				f, err := lvbackup.OpenInput(input)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(2)
+				}
+				defer f.Close()
+				in = f
+			}
+			recver, err := lvbackup.NewStreamRecver(vgname, poolname, baseLv, flg, in)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(2)
 			}
+			recver.SetDecryption(key)
+			if len(targetFile) > 0 {
+				recver.SetImages(targetFile, baseFile)
+			} else if len(baseFile) > 0 {
+				fmt.Fprintln(os.Stderr, "--base-file needs --target-file")
+				os.Exit(-1)
+			}
+			if err := recver.SetJobs(jobs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(-1)
+			}
+			recver.SetVerify(verify)
+			recver.SetDryRun(dryRun)
+			recver.SetInPlace(inPlace)
+			if stateFile != "" && dryRun {
+				fmt.Fprintln(os.Stderr, "--resume can not be used with --dry-run")
+				os.Exit(-1)
+			}
+			if stateFile != "" {
+				recver.SetResume(stateFile)
+			}
+			if trustedKeys != "" || requireSig || sigFile != "" {
+				var keys []ed25519.PublicKey
+				if trustedKeys != "" {
+					if keys, err = lvbackup.LoadTrustedKeys(trustedKeys); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						os.Exit(-1)
+					}
+				}
+				if err := recver.SetVerification(keys, requireSig, sigFile); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(-1)
+				}
+			}
 
 			if err := recver.Run(newLv); err != nil {
 				fmt.Fprintln(os.Stderr, err)
@@ -47,8 +118,21 @@ func main() {
 
 	rootCmd.Flags().StringVarP(&vgname, "lvgroup", "g", "", "volume group")
 	rootCmd.Flags().BoolVarP(&flg, "no-base-check", "", false, "patch volume without check blocks' hash.")
-	//rootCmd.Flags().StringVarP(&poolname, "pool", "p", "", "thin pool")
-	rootCmd.Flags().StringVarP(&baseLv, "lvbase", "l", "", "base logical volume")
+	rootCmd.Flags().StringVarP(&poolname, "pool", "p", "", "create the new volume in this thin pool (full stream only)")
+	rootCmd.Flags().StringVarP(&baseLv, "lvbase", "l", "", "base logical volume (not needed for a full stream)")
+	rootCmd.Flags().StringVarP(&inPlace, "in-place", "", "", "patch this thin volume directly, if it is tagged as a copy of the stream's base")
+	rootCmd.Flags().StringVarP(&targetFile, "target-file", "", "", "patch into a new raw image file instead of a thin volume")
+	rootCmd.Flags().StringVarP(&baseFile, "base-file", "", "", "base image of a delta stream (with --target-file)")
+	rootCmd.Flags().StringVarP(&input, "input", "i", "", "read the stream from this file, or from the segments listed by a manifest of lvdiff --split-size")
+	rootCmd.Flags().StringVarP(&keyFile, "key-file", "", "", "key file of an encrypted stream")
+	rootCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "passphrase file of an encrypted stream")
+	rootCmd.Flags().StringVarP(&trustedKeys, "trusted-keys", "", "", "verify stream signatures with the Ed25519 public keys (PEM) in this file")
+	rootCmd.Flags().BoolVarP(&requireSig, "require-signature", "", false, "refuse unsigned streams")
+	rootCmd.Flags().StringVarP(&sigFile, "signature", "", "", "detached signature file of the stream")
+	rootCmd.Flags().IntVarP(&jobs, "jobs", "j", lvbackup.DefaultJobs, "number of parallel writers")
+	rootCmd.Flags().BoolVarP(&verify, "verify", "", false, "read back every written block and compare it with the stream")
+	rootCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false, "check the stream and the target without writing anything")
+	rootCmd.Flags().StringVarP(&stateFile, "resume", "", "", "checkpoint progress to this state file and continue from it after a failure")
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(-1)